@@ -0,0 +1,103 @@
+package mantra
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/urfave/negroni"
+)
+
+// AccessLogOptions configures AccessLog, the zero value logs everything at info,
+// client errors at warn and server errors at error
+type AccessLogOptions struct {
+	Level            slog.Leveler // 1xx-3xx, default slog.LevelInfo
+	ClientErrorLevel slog.Leveler // 4xx, default slog.LevelWarn
+	ServerErrorLevel slog.Leveler // 5xx, default slog.LevelError
+
+	// ExcludePaths aren't logged unless they fail, e.g. "/healthz". A trailing * matches by prefix
+	ExcludePaths []string
+}
+
+// AccessLog is middleware logging every request to log with structured attributes, including
+// the request_id and trace_id whether or not log's handler is wrapped with NewContextHandler
+func AccessLog(log *slog.Logger, opts AccessLogOptions) negroni.HandlerFunc {
+	log = slog.New(NewContextHandler(log.Handler()))
+	if opts.Level == nil {
+		opts.Level = slog.LevelInfo
+	}
+	if opts.ClientErrorLevel == nil {
+		opts.ClientErrorLevel = slog.LevelWarn
+	}
+	if opts.ServerErrorLevel == nil {
+		opts.ServerErrorLevel = slog.LevelError
+	}
+
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		start := time.Now()
+		req, info := ensureRequestInfo(req)
+		nw, ok := w.(negroni.ResponseWriter)
+		if !ok {
+			nw = negroni.NewResponseWriter(w)
+		}
+
+		next(nw, req)
+
+		status := nw.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := opts.Level.Level()
+		switch {
+		case status >= 500:
+			level = opts.ServerErrorLevel.Level()
+		case status >= 400:
+			level = opts.ClientErrorLevel.Level()
+		case excludedPath(opts.ExcludePaths, req.URL.Path):
+			return
+		}
+
+		ctx := req.Context()
+		if !log.Enabled(ctx, level) {
+			return
+		}
+		attrs := []slog.Attr{
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.String("route", info.route),
+			slog.Int("status", status),
+			slog.Int("size", nw.Size()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_ip", remoteIP(req)),
+		}
+		if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+			attrs = append(attrs, slog.String("forwarded_for", forwarded))
+		}
+		if info.user != nil {
+			attrs = append(attrs, slog.String("user", info.user.ULID), slog.String("site_ulid", info.user.SiteULID))
+		}
+		log.LogAttrs(ctx, level, "Request", attrs...)
+	}
+}
+
+func excludedPath(excluded []string, path string) bool {
+	for _, ex := range excluded {
+		if ex == path {
+			return true
+		}
+		if strings.HasSuffix(ex, "*") && strings.HasPrefix(path, strings.TrimSuffix(ex, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
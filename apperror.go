@@ -0,0 +1,176 @@
+package mantra
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/twitchtv/twirp"
+)
+
+// ErrorCode classifies an Error, it decides the HTTP status and twirp code of the response
+type ErrorCode string
+
+const (
+	CodeBadRequest      ErrorCode = "bad_request"
+	CodeValidation      ErrorCode = "validation"
+	CodeUnauthenticated ErrorCode = "unauthenticated"
+	CodeForbidden       ErrorCode = "forbidden"
+	CodeNotFound        ErrorCode = "not_found"
+	CodeConflict        ErrorCode = "conflict"
+	CodeTooLarge        ErrorCode = "too_large"
+	CodeTimeout         ErrorCode = "timeout"
+	CodeInternal        ErrorCode = "internal"
+)
+
+var codeStatuses = map[ErrorCode]int{
+	CodeBadRequest:      http.StatusBadRequest,
+	CodeValidation:      http.StatusUnprocessableEntity,
+	CodeUnauthenticated: http.StatusUnauthorized,
+	CodeForbidden:       http.StatusForbidden,
+	CodeNotFound:        http.StatusNotFound,
+	CodeConflict:        http.StatusConflict,
+	CodeTooLarge:        http.StatusRequestEntityTooLarge,
+	CodeTimeout:         http.StatusGatewayTimeout,
+	CodeInternal:        http.StatusInternalServerError,
+}
+
+var codeTwirpCodes = map[ErrorCode]twirp.ErrorCode{
+	CodeBadRequest:      twirp.InvalidArgument,
+	CodeValidation:      twirp.InvalidArgument,
+	CodeUnauthenticated: twirp.Unauthenticated,
+	CodeForbidden:       twirp.PermissionDenied,
+	CodeNotFound:        twirp.NotFound,
+	CodeConflict:        twirp.AlreadyExists,
+	CodeTooLarge:        twirp.ResourceExhausted,
+	CodeTimeout:         twirp.DeadlineExceeded,
+	CodeInternal:        twirp.Internal,
+}
+
+// Error is an application error, Friendly is shown to the user and Cause is logged
+type Error struct {
+	Code     ErrorCode
+	Friendly string
+	Cause    error
+
+	loc location // where it was created, for the error response
+}
+
+func (e *Error) Error() string {
+	if e.Cause == nil {
+		return e.Friendly
+	}
+	return e.Friendly + ": " + e.Cause.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+// NewError creates an application error, cause can be nil
+func NewError(code ErrorCode, friendly string, cause error) *Error {
+	return &Error{
+		Code:     code,
+		Friendly: friendly,
+		Cause:    cause,
+		loc:      callerOutside(),
+	}
+}
+
+func BadRequest(friendly string, cause error) *Error {
+	return NewError(CodeBadRequest, friendly, cause)
+}
+
+// Validation carries the field errors in the response
+func Validation(friendly string, fields FieldErrors) *Error {
+	return NewError(CodeValidation, friendly, fields)
+}
+
+func Unauthenticated(friendly string, cause error) *Error {
+	return NewError(CodeUnauthenticated, friendly, cause)
+}
+
+func Forbidden(friendly string, cause error) *Error {
+	return NewError(CodeForbidden, friendly, cause)
+}
+
+func NotFound(friendly string, cause error) *Error {
+	return NewError(CodeNotFound, friendly, cause)
+}
+
+func Conflict(friendly string, cause error) *Error {
+	return NewError(CodeConflict, friendly, cause)
+}
+
+func Internal(friendly string, cause error) *Error {
+	return NewError(CodeInternal, friendly, cause)
+}
+
+// codeFor works out the ErrorCode of any error, unwrapping to find an Error or something we know,
+// e.g. a datastore "no rows" error is CodeNotFound
+func codeFor(err error) ErrorCode {
+	var appErr *Error
+	var fieldErrs FieldErrors
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &appErr):
+		return appErr.Code
+	case errors.Is(err, pgx.ErrNoRows), errors.Is(err, sql.ErrNoRows):
+		return CodeNotFound
+	case errors.As(err, &fieldErrs):
+		return CodeValidation
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	}
+	return CodeInternal
+}
+
+// StatusFor maps an error to its HTTP status, a Problem keeps its own status
+func StatusFor(err error) int {
+	var problem *Problem
+	if errors.As(err, &problem) && problem.Status != 0 {
+		return problem.Status
+	}
+	if status, ok := codeStatuses[codeFor(err)]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// FriendlyFor returns the message to show the user for an error
+func FriendlyFor(err error) string {
+	var appErr *Error
+	if errors.As(err, &appErr) && appErr.Friendly != "" {
+		return appErr.Friendly
+	}
+	if codeFor(err) == CodeNotFound {
+		return "Not found"
+	}
+	return http.StatusText(StatusFor(err))
+}
+
+// TwirpError converts an error for returning from a twirp method, the cause stays server side
+func TwirpError(err error) twirp.Error {
+	if err == nil {
+		return nil
+	}
+	var twerr twirp.Error
+	if errors.As(err, &twerr) {
+		return twerr
+	}
+	code, ok := codeTwirpCodes[codeFor(err)]
+	if !ok {
+		code = twirp.Internal
+	}
+	twerr = twirp.WrapError(twirp.NewError(code, FriendlyFor(err)), err)
+	var fieldErrs FieldErrors
+	if errors.As(err, &fieldErrs) {
+		for field, msg := range fieldErrs {
+			twerr = twerr.WithMeta(field, msg)
+		}
+	}
+	return twerr
+}
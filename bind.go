@@ -0,0 +1,181 @@
+package mantra
+
+import (
+	"encoding"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-zoo/bone"
+	"github.com/oklog/ulid/v2"
+)
+
+// MaxFormMemory is how much of a multipart form Bind keeps in memory
+var MaxFormMemory int64 = 32 << 20
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	ulidType = reflect.TypeOf(ulid.ULID{})
+)
+
+// Bind fills the struct dst points at from the request. A JSON body is decoded first (see DecodeJSON),
+// then fields tagged with `param:"id"` (route values), `query:"page"` or `form:"email"` are set from those
+// values when present. Times parse as RFC3339Nano unless tagged with a layout, e.g. `layout:"20060102"`.
+//
+// Supports strings, bools (any BoolParam truthy value), ints, uints, floats, time.Time, ulid.ULID,
+// encoding.TextUnmarshaler and pointers and slices of those. Values that don't parse come back as FieldErrors
+// in a Validation error (422), like Validate
+func Bind(req *http.Request, dst any) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return errors.New("mantra.Bind needs a pointer to a struct")
+	}
+
+	if strings.Contains(req.Header.Get("Content-Type"), "application/json") {
+		if err := DecodeJSON(nil, req, dst); err != nil {
+			return err
+		}
+	} else if strings.Contains(req.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := req.ParseMultipartForm(MaxFormMemory); err != nil {
+			return BadRequest("Invalid form", err)
+		}
+	} else if err := req.ParseForm(); err != nil {
+		return BadRequest("Invalid form", err)
+	}
+
+	fieldErrs := FieldErrors{}
+	bindStruct(req, v.Elem(), fieldErrs)
+	if len(fieldErrs) > 0 {
+		return Validation("Invalid request", fieldErrs)
+	}
+	return nil
+}
+
+func bindStruct(req *http.Request, v reflect.Value, fieldErrs FieldErrors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			bindStruct(req, v.Field(i), fieldErrs)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		name, vals := bindValues(req, field)
+		if len(vals) == 0 {
+			continue
+		}
+		if err := setField(v.Field(i), vals, field.Tag.Get("layout")); err != nil {
+			fieldErrs[name] = err.Error()
+		}
+	}
+}
+
+// bindValues finds the values for a field from whichever source it's tagged with
+func bindValues(req *http.Request, field reflect.StructField) (string, []string) {
+	if name := field.Tag.Get("param"); name != "" {
+		value := bone.GetValue(req, name)
+		if value == "" {
+			return name, nil
+		}
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+		return name, []string{value}
+	}
+	if name := field.Tag.Get("query"); name != "" {
+		return name, req.URL.Query()[name]
+	}
+	if name := field.Tag.Get("form"); name != "" {
+		if req.MultipartForm != nil {
+			return name, req.MultipartForm.Value[name]
+		}
+		return name, req.PostForm[name]
+	}
+	return "", nil
+}
+
+func setField(v reflect.Value, vals []string, layout string) error {
+	switch {
+	case v.Kind() == reflect.Pointer:
+		elem := reflect.New(v.Type().Elem())
+		if err := setField(elem.Elem(), vals, layout); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8:
+		slice := reflect.MakeSlice(v.Type(), len(vals), len(vals))
+		for i, val := range vals {
+			if err := setValue(slice.Index(i), val, layout); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	}
+	return setValue(v, vals[0], layout)
+}
+
+func setValue(v reflect.Value, val string, layout string) error {
+	switch v.Type() {
+	case timeType:
+		if layout == "" {
+			layout = time.RFC3339Nano
+		}
+		t, err := time.Parse(layout, val)
+		if err != nil {
+			return errors.New("must be a date in the format " + layout)
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	case ulidType:
+		id, err := ulid.Parse(strings.ToUpper(val))
+		if err != nil {
+			return errors.New("must be a ULID")
+		}
+		v.Set(reflect.ValueOf(id))
+		return nil
+	}
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(val))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(val)
+	case reflect.Bool:
+		b, err := parseBool(val)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(val, 10, v.Type().Bits())
+		if err != nil {
+			return errors.New("must be a whole number")
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(val, 10, v.Type().Bits())
+		if err != nil {
+			return errors.New("must be a positive whole number")
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(val, v.Type().Bits())
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		v.SetFloat(f)
+	default:
+		return errors.New("can't bind a " + v.Type().String())
+	}
+	return nil
+}
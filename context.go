@@ -0,0 +1,113 @@
+package mantra
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nerdynz/datastore"
+	"github.com/nerdynz/security"
+)
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	requestKey
+	requestIDKey
+	siteULIDKey
+	authTokenKey
+	requestInfoKey
+	tracedKey
+	csrfTokenKey
+)
+
+// requestInfo is shared by the outer middleware (access logs etc) and filled in as the request is routed
+type requestInfo struct {
+	route      string
+	authMethod AuthMethod
+	user       *security.SessionUser
+}
+
+// ensureRequestInfo attaches a requestInfo to the request if it doesn't have one yet
+func ensureRequestInfo(req *http.Request) (*http.Request, *requestInfo) {
+	if info, ok := req.Context().Value(requestInfoKey).(*requestInfo); ok {
+		return req, info
+	}
+	info := &requestInfo{}
+	return req.WithContext(context.WithValue(req.Context(), requestInfoKey, info)), info
+}
+
+// routed records the route a request matched, if something outside the router is interested
+func routed(ctx context.Context, route string, authMethod AuthMethod) {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		info.route = route
+		info.authMethod = authMethod
+	}
+}
+
+// CurrentUser returns the logged in user for the request, nil on OPEN routes and services
+func CurrentUser(ctx context.Context) *security.SessionUser {
+	user, _ := ctx.Value(userKey).(*security.SessionUser)
+	return user
+}
+
+// RequestID returns the id of the current request
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// CSRFToken returns the token the CSRF middleware expects back, blank on routes without it
+func CSRFToken(ctx context.Context) string {
+	token, _ := ctx.Value(csrfTokenKey).(string)
+	return token
+}
+
+func withCSRFToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, csrfTokenKey, token)
+}
+
+// SiteULID returns the site of the logged in user, blank on OPEN routes and services
+func SiteULID(ctx context.Context) string {
+	siteULID, _ := ctx.Value(siteULIDKey).(string)
+	return siteULID
+}
+
+// AuthToken returns the auth token the user logged in with, blank on OPEN routes and services
+func AuthToken(ctx context.Context) string {
+	token, _ := ctx.Value(authTokenKey).(string)
+	return token
+}
+
+// withLogin stores the logged in user and their details
+func withLogin(ctx context.Context, user *security.SessionUser, authToken string) context.Context {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		info.user = user
+	}
+	ctx = context.WithValue(ctx, userKey, user)
+	ctx = context.WithValue(ctx, siteULIDKey, user.SiteULID)
+	ctx = context.WithValue(ctx, authTokenKey, authToken)
+	ctx = context.WithValue(ctx, "site_ulid", user.SiteULID) // untyped key kept for existing callers, use SiteULID
+	return ctx
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey, id)
+	ctx = context.WithValue(ctx, "request_id", id) // untyped key kept for existing callers, use RequestID
+	return ctx
+}
+
+// ensureRequestID gives the request an id if it doesn't have one yet
+func ensureRequestID(req *http.Request) *http.Request {
+	if RequestID(req.Context()) != "" {
+		return req
+	}
+	return req.WithContext(withRequestID(req.Context(), datastore.ULID()))
+}
+
+// withRequestIDs gives requests to h an id if they don't have one yet
+func withRequestIDs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(w, ensureRequestID(req))
+	})
+}
@@ -0,0 +1,122 @@
+package mantra
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// CookieSecret signs the cookies mantra keeps state in between requests, e.g. form errors across a redirect.
+// nil falls back to SECURITY_ENCRYPTION_KEY, then to a random key that only lasts as long as the process
+var CookieSecret []byte
+
+// maxCookieBytes keeps a signed cookie under the browsers 4KB limit
+const maxCookieBytes = 3800
+
+var errCookieTooLarge = errors.New("cookie too large")
+
+var (
+	fallbackSecretOnce sync.Once
+	fallbackSecret     []byte
+)
+
+func cookieSecret() []byte {
+	if len(CookieSecret) > 0 {
+		return CookieSecret
+	}
+	if key := os.Getenv("SECURITY_ENCRYPTION_KEY"); key != "" {
+		return []byte(key)
+	}
+	fallbackSecretOnce.Do(func() {
+		slog.Warn("mantra: no CookieSecret or SECURITY_ENCRYPTION_KEY, signed cookies won't survive a restart or work across instances")
+		fallbackSecret = make([]byte, 32)
+		rand.Read(fallbackSecret)
+	})
+	return fallbackSecret
+}
+
+func sign(payload string) string {
+	mac := hmac.New(sha256.New, cookieSecret())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setSignedCookie stores v as signed json, it's readable by the client but can't be changed
+func setSignedCookie(w http.ResponseWriter, req *http.Request, name string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	value := payload + "." + sign(payload)
+	if len(value) > maxCookieBytes {
+		return errCookieTooLarge
+	}
+	replaceCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   secureRequest(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// readSignedCookie decodes the named cookie into dst, false if it's missing or the signature doesn't match
+func readSignedCookie(req *http.Request, name string, dst any) bool {
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return false
+	}
+	payload, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(sign(payload))) {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(b, dst) == nil
+}
+
+func clearCookie(w http.ResponseWriter, req *http.Request, name string) {
+	replaceCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureRequest(req),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// replaceCookie sets cookie, dropping any earlier Set-Cookie for the same name in this response
+func replaceCookie(w http.ResponseWriter, cookie *http.Cookie) {
+	header := w.Header()
+	kept := header.Values("Set-Cookie")[:0:0]
+	for _, line := range header.Values("Set-Cookie") {
+		if !strings.HasPrefix(line, cookie.Name+"=") {
+			kept = append(kept, line)
+		}
+	}
+	header.Del("Set-Cookie")
+	for _, line := range kept {
+		header.Add("Set-Cookie", line)
+	}
+	http.SetCookie(w, cookie)
+}
+
+// secureRequest is whether the client connected over https, directly or through a proxy
+func secureRequest(req *http.Request) bool {
+	return req.TLS != nil || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https")
+}
@@ -0,0 +1,189 @@
+package mantra
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions says which other origins may call a router or twirp service from the browser
+type CORSOptions struct {
+	// AllowedOrigins e.g. "https://app.example.com", "https://*.example.com" for any subdomain, or "*" for anyone
+	AllowedOrigins []string
+	// AllowedMethods defaults to GET, HEAD, POST, PUT, PATCH and DELETE
+	AllowedMethods []string
+	// AllowedHeaders the browser may send, defaults to the ones mantra uses. "*" allows any
+	AllowedHeaders []string
+	// ExposedHeaders the browser lets scripts read from the response
+	ExposedHeaders []string
+	// AllowCredentials lets cookies and the Authorization header through, it can't be used with an origin of "*"
+	AllowCredentials bool
+	// MaxAge is how long the browser may cache a preflight, 0 leaves it to the browser
+	MaxAge time.Duration
+}
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	defaultCORSHeaders = []string{"Accept", "Accept-Language", "Content-Language", "Content-Type", "Authorization", RequestIDHeader, CSRFHeader}
+)
+
+type corsPolicy struct {
+	opts    CORSOptions
+	methods []string
+	headers []string
+}
+
+// newCORSPolicy panics on AllowCredentials with an origin of "*", it would let any site act as the logged in user
+func newCORSPolicy(opts CORSOptions) *corsPolicy {
+	if opts.AllowCredentials && slices.Contains(opts.AllowedOrigins, "*") {
+		panic(`mantra: CORS AllowCredentials can't be used with an AllowedOrigins of "*", list the origins`)
+	}
+	c := &corsPolicy{opts: opts, headers: opts.AllowedHeaders}
+	methods := opts.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	for _, method := range methods {
+		c.methods = append(c.methods, strings.ToUpper(method))
+	}
+	if len(c.headers) == 0 {
+		c.headers = defaultCORSHeaders
+	}
+	return c
+}
+
+// CORS applies opts to every route registered on this router (or group) from now on, answering their
+// preflight OPTIONS requests before authentication. Twirp services pick it up too unless they have WithCORS
+//
+//	api := router.Group("/api", mantra.SECURE)
+//	api.CORS(mantra.CORSOptions{AllowedOrigins: []string{"https://*.example.com"}, AllowCredentials: true})
+func (customRouter *CustomRouter) CORS(opts CORSOptions) {
+	customRouter.cors = newCORSPolicy(opts)
+}
+
+// WithCORS applies opts to a twirp service, preflight requests are answered before authentication
+func WithCORS(opts CORSOptions) TwirpOption {
+	return func(reg *twirpRegistration) {
+		reg.cors = newCORSPolicy(opts)
+	}
+}
+
+// preflight registers an OPTIONS route for pattern so browsers can ask before calling it,
+// unless it already has one
+func (customRouter *CustomRouter) preflight(pattern string, register bool) {
+	key := strings.ToLower(pattern)
+	if customRouter.preflights[key] {
+		return
+	}
+	customRouter.preflights[key] = true
+	if !register {
+		return
+	}
+	customRouter.Mux.Options(pattern, customRouter.cors.handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNoContent) // an OPTIONS request that isn't a preflight
+	})))
+}
+
+// handler adds the CORS headers for allowed origins and answers preflight requests without calling next
+func (c *corsPolicy) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header := w.Header()
+		header.Add("Vary", "Origin") // even without one, so caches don't hand this response to a cross origin request
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+
+		if !c.allowedOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, req) // the browser won't let the page read it
+			return
+		}
+
+		if !preflight {
+			c.allowOrigin(header, origin)
+			if len(c.opts.ExposedHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(c.opts.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		method := strings.ToUpper(req.Header.Get("Access-Control-Request-Method"))
+		requested := requestedHeaders(req)
+		if !slices.Contains(c.methods, method) || !c.allowedHeaders(requested) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		c.allowOrigin(header, origin)
+		header.Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+		if len(requested) > 0 {
+			header.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+		}
+		if c.opts.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.opts.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (c *corsPolicy) allowOrigin(header http.Header, origin string) {
+	if slices.Contains(c.opts.AllowedOrigins, "*") {
+		header.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if c.opts.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (c *corsPolicy) allowedOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range c.opts.AllowedOrigins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		// https://*.example.com matches any subdomain of example.com, but not example.com itself
+		scheme, host, ok := strings.Cut(allowed, "*")
+		if ok && strings.HasPrefix(host, ".") && strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, host) &&
+			len(origin) > len(scheme)+len(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *corsPolicy) allowedHeaders(requested []string) bool {
+	if slices.Contains(c.headers, "*") {
+		return true
+	}
+	for _, name := range requested {
+		if !slices.ContainsFunc(c.headers, func(allowed string) bool { return strings.EqualFold(allowed, name) }) {
+			return false
+		}
+	}
+	return true
+}
+
+func requestedHeaders(req *http.Request) []string {
+	var names []string
+	for _, line := range req.Header.Values("Access-Control-Request-Headers") {
+		for _, name := range strings.Split(line, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,147 @@
+package mantra
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nerdynz/datastore"
+)
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	c := newCORSPolicy(CORSOptions{AllowedOrigins: []string{"https://*.example.com", "http://localhost:3000"}})
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"https://a.b.example.com", true},
+		{"HTTPS://App.Example.com", true},
+		{"http://localhost:3000", true},
+		{"https://example.com", false},
+		{"https://.example.com", false},
+		{"http://app.example.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://evilexample.com", false},
+		{"http://localhost:3001", false},
+	}
+	for _, tt := range tests {
+		if got := c.allowedOrigin(tt.origin); got != tt.want {
+			t.Errorf("allowedOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	router := Router(&datastore.Datastore{Settings: testSettings{}})
+	router.CORS(CORSOptions{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		ExposedHeaders:   []string{RequestIDHeader},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	router.GET("/invoices", func(w http.ResponseWriter, req *http.Request, store *datastore.Datastore) {
+		io.WriteString(w, "invoices")
+	}, OPEN)
+
+	serve := func(method string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/invoices", nil)
+		for name, values := range header {
+			req.Header.Set(name, values[0])
+		}
+		w := httptest.NewRecorder()
+		router.Mux.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("allowed origin", func(t *testing.T) {
+		w := serve("GET", http.Header{"Origin": {"https://app.example.com"}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+		wantHeader(t, w, "Access-Control-Allow-Origin", "https://app.example.com")
+		wantHeader(t, w, "Access-Control-Allow-Credentials", "true")
+		wantHeader(t, w, "Access-Control-Expose-Headers", RequestIDHeader)
+		wantVary(t, w, "Origin")
+	})
+
+	t.Run("disallowed origin", func(t *testing.T) {
+		w := serve("GET", http.Header{"Origin": {"https://example.com"}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+		wantHeader(t, w, "Access-Control-Allow-Origin", "")
+		wantVary(t, w, "Origin")
+	})
+
+	t.Run("same origin", func(t *testing.T) {
+		w := serve("GET", nil)
+		wantHeader(t, w, "Access-Control-Allow-Origin", "")
+		wantVary(t, w, "Origin")
+	})
+
+	t.Run("preflight", func(t *testing.T) {
+		w := serve("OPTIONS", http.Header{
+			"Origin":                         {"https://app.example.com"},
+			"Access-Control-Request-Method":  {"post"},
+			"Access-Control-Request-Headers": {"content-type, x-csrf-token"},
+		})
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("status %d, want %d", w.Code, http.StatusNoContent)
+		}
+		wantHeader(t, w, "Access-Control-Allow-Origin", "https://app.example.com")
+		wantHeader(t, w, "Access-Control-Allow-Credentials", "true")
+		wantHeader(t, w, "Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE")
+		wantHeader(t, w, "Access-Control-Allow-Headers", "content-type, x-csrf-token")
+		wantHeader(t, w, "Access-Control-Max-Age", "600")
+		wantVary(t, w, "Access-Control-Request-Headers")
+	})
+
+	t.Run("preflight from a disallowed origin", func(t *testing.T) {
+		w := serve("OPTIONS", http.Header{
+			"Origin":                        {"https://example.com"},
+			"Access-Control-Request-Method": {"POST"},
+		})
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("status %d, want %d", w.Code, http.StatusForbidden)
+		}
+		wantHeader(t, w, "Access-Control-Allow-Origin", "")
+	})
+
+	t.Run("preflight for a disallowed header", func(t *testing.T) {
+		w := serve("OPTIONS", http.Header{
+			"Origin":                         {"https://app.example.com"},
+			"Access-Control-Request-Method":  {"POST"},
+			"Access-Control-Request-Headers": {"X-Custom"},
+		})
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("status %d, want %d", w.Code, http.StatusForbidden)
+		}
+	})
+}
+
+func TestCORSCredentialsWithAnyOrigin(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error(`AllowCredentials with an origin of "*" didn't panic`)
+		}
+	}()
+	newCORSPolicy(CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+}
+
+func wantHeader(t *testing.T, w *httptest.ResponseRecorder, name string, want string) {
+	t.Helper()
+	if got := w.Header().Get(name); got != want {
+		t.Errorf("%s = %q, want %q", name, got, want)
+	}
+}
+
+func wantVary(t *testing.T, w *httptest.ResponseRecorder, name string) {
+	t.Helper()
+	if !slices.Contains(w.Header().Values("Vary"), name) {
+		t.Errorf("Vary %q is missing %s", w.Header().Values("Vary"), name)
+	}
+}
@@ -0,0 +1,121 @@
+package mantra
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/nerdynz/datastore"
+)
+
+const (
+	// CSRFCookie holds the token forms and ajax requests have to send back
+	CSRFCookie = "mantra_csrf"
+	// CSRFHeader is where ajax requests send the token
+	CSRFHeader = "X-CSRF-Token"
+	// CSRFField is the form field csrfField renders
+	CSRFField = "csrf_token"
+)
+
+// SessionCookie is the login cookie CSRF tokens are tied to, the security packages default
+var SessionCookie = "UserCookie"
+
+var errCSRF = errors.New("csrf token missing or invalid")
+
+// CSRF protects cookie authenticated routes from cross site form posts with a signed double submit token,
+// tied to the login so a token planted from another subdomain won't pass. Unsafe methods must send the token
+// back in the CSRFField form value or the CSRFHeader, templates add it with {{csrfField $}} or {{csrfToken $}}.
+// Twirp and Bearer token requests can't be forged cross site so they're let through, anything else without
+// a matching token gets a 403
+//
+//	router.Use(mantra.CSRF())
+func CSRF() Middleware {
+	return func(next CustomHandlerFunc) CustomHandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request, store *datastore.Datastore) {
+			if isTwirpRequest(req) || bearerToken(req) {
+				next(w, req, store)
+				return
+			}
+
+			session := csrfSession(req)
+			token := csrfCookieToken(req, session)
+			if token == "" {
+				token = newCSRFToken(session)
+				replaceCookie(w, &http.Cookie{
+					Name:     CSRFCookie,
+					Value:    token,
+					Path:     "/",
+					HttpOnly: true,
+					Secure:   secureRequest(req),
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+
+			switch req.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			default:
+				submitted := req.Header.Get(CSRFHeader)
+				if submitted == "" {
+					submitted = req.FormValue(CSRFField)
+				}
+				if subtle.ConstantTimeCompare([]byte(submitted), []byte(token)) != 1 {
+					view := NewViewBucket(w, req, store)
+					view.Error(http.StatusForbidden, "Your session has expired, please reload the page and try again", errCSRF)
+					return
+				}
+			}
+
+			next(w, req.WithContext(withCSRFToken(req.Context(), token)), store)
+		}
+	}
+}
+
+// bearerToken is a request authenticated by a header the browser won't add by itself,
+// unlike Basic or Digest credentials it has cached
+func bearerToken(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	return len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ")
+}
+
+// csrfSession identifies the login the token belongs to, blank when logged out
+func csrfSession(req *http.Request) string {
+	if cookie, err := req.Cookie(SessionCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	return AuthToken(req.Context())
+}
+
+// csrfCookieToken is the token from the CSRFCookie, blank when there isn't one or it wasn't signed by us for session
+func csrfCookieToken(req *http.Request, session string) string {
+	cookie, err := req.Cookie(CSRFCookie)
+	if err != nil {
+		return ""
+	}
+	random, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || subtle.ConstantTimeCompare([]byte(sig), []byte(sign(random+"|"+session))) != 1 {
+		return ""
+	}
+	return cookie.Value
+}
+
+func newCSRFToken(session string) string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	random := base64.RawURLEncoding.EncodeToString(b)
+	return random + "." + sign(random+"|"+session)
+}
+
+// csrfToken is the token for the current request, {{csrfToken $}} e.g. for a meta tag ajax can read
+func csrfToken(data any) string {
+	token, _ := viewValue(data, "CSRFToken").(string)
+	return token
+}
+
+// csrfField is a hidden input carrying the token, {{csrfField $}} inside a form
+func csrfField(data any) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + CSRFField + `" value="` + template.HTMLEscapeString(csrfToken(data)) + `">`)
+}
@@ -0,0 +1,98 @@
+package mantra
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/nerdynz/datastore"
+)
+
+func TestCSRF(t *testing.T) {
+	withTemplates(t)
+	router := Router(&datastore.Datastore{Settings: testSettings{}})
+	router.Use(CSRF())
+	router.GET("/invoices/new", func(w http.ResponseWriter, req *http.Request, store *datastore.Datastore) {
+		io.WriteString(w, CSRFToken(req.Context()))
+	}, OPEN)
+	router.POST("/invoices", func(w http.ResponseWriter, req *http.Request, store *datastore.Datastore) {
+		io.WriteString(w, "saved")
+	}, OPEN)
+
+	// form is a GET for the token as the browser would with the login cookie session, the CSRF cookie it set and the token
+	form := func(session string) (*http.Cookie, string) {
+		req := httptest.NewRequest("GET", "/invoices/new", nil)
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session})
+		w := httptest.NewRecorder()
+		router.Mux.ServeHTTP(w, req)
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == CSRFCookie {
+				return cookie, w.Body.String()
+			}
+		}
+		t.Fatalf("no %s cookie set", CSRFCookie)
+		return nil, ""
+	}
+	post := func(session string, cookie *http.Cookie, token string, header http.Header) int {
+		req := httptest.NewRequest("POST", "/invoices", strings.NewReader(url.Values{CSRFField: {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for name, values := range header {
+			req.Header.Set(name, values[0])
+		}
+		req.AddCookie(&http.Cookie{Name: SessionCookie, Value: session})
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		router.Mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	cookie, token := form("session-1")
+	if token == "" || token != cookie.Value {
+		t.Fatalf("token %q doesn't match the cookie %q", token, cookie.Value)
+	}
+
+	tests := []struct {
+		name    string
+		session string
+		cookie  *http.Cookie
+		token   string
+		header  http.Header
+		want    int
+	}{
+		{"form token", "session-1", cookie, token, nil, http.StatusOK},
+		{"header token", "session-1", cookie, "", http.Header{CSRFHeader: {token}}, http.StatusOK},
+		{"missing token", "session-1", cookie, "", nil, http.StatusForbidden},
+		{"missing cookie", "session-1", nil, token, nil, http.StatusForbidden},
+		{"wrong token", "session-1", cookie, token + "x", nil, http.StatusForbidden},
+		{"another login's token", "session-2", cookie, token, nil, http.StatusForbidden},
+		{"basic auth isn't exempt", "session-1", nil, "", http.Header{"Authorization": {"Basic dXNlcjpwYXNz"}}, http.StatusForbidden},
+		{"bearer token is exempt", "", nil, "", http.Header{"Authorization": {"Bearer abc123"}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := post(tt.session, tt.cookie, tt.token, tt.header); got != tt.want {
+				t.Errorf("status %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSRFTwirpExempt(t *testing.T) {
+	addTwirpPrefix("/twirp/csrftest.invoices/")
+	router := Router(&datastore.Datastore{Settings: testSettings{}})
+	router.Use(CSRF())
+	router.POST("/twirp/csrftest.invoices/list", func(w http.ResponseWriter, req *http.Request, store *datastore.Datastore) {
+		io.WriteString(w, "listed")
+	}, OPEN)
+
+	w := httptest.NewRecorder()
+	router.Mux.ServeHTTP(w, httptest.NewRequest("POST", "/twirp/csrftest.invoices/list", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d, want %d", w.Code, http.StatusOK)
+	}
+}
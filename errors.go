@@ -2,62 +2,225 @@ package mantra
 
 import (
 	"encoding/json"
+	"errors"
+	"html"
 	"log/slog"
 	"net/http"
 	"runtime"
 	"strconv"
+	"strings"
+
+	"github.com/nerdynz/datastore"
 )
 
 // errorData represents a standardized error response
 type errorData struct {
+	Reference    string
+	RequestID    string `json:",omitempty"`
+	TraceID      string `json:",omitempty"`
 	Friendly     string
-	Error        string
-	LineNumber   int
-	FunctionName string
-	FileName     string
+	Error        string      `json:",omitempty"`
+	LineNumber   int         `json:",omitempty"`
+	FunctionName string      `json:",omitempty"`
+	FileName     string      `json:",omitempty"`
+	Fields       FieldErrors `json:",omitempty"` // what's wrong with each submitted field, safe to show anyone
+}
+
+// ErrorDetailsFor lets trusted users see full error details in production, e.g. mantra.RequireRole("superadmin").
+// Only applies on routes the user is authenticated on. nil, the default, means nobody does
+var ErrorDetailsFor Policy
+
+// showErrorDetails decides if the client gets the error, file and line or only the friendly message and reference
+func showErrorDetails(req *http.Request, store *datastore.Datastore) bool {
+	if store != nil && store.Settings != nil && !store.Settings.IsProduction() {
+		return true
+	}
+	if ErrorDetailsFor != nil && ErrorDetailsFor(req.Context(), CurrentUser(req.Context())) == nil {
+		return true
+	}
+	return false
+}
+
+// forClient returns what the client is allowed to see, the full detail is always in the logs under Reference
+func (e *errorData) forClient(showDetails bool) *errorData {
+	if showDetails {
+		return e
+	}
+	return &errorData{
+		Reference: e.Reference,
+		RequestID: e.RequestID,
+		TraceID:   e.TraceID,
+		Friendly:  e.Friendly,
+		Fields:    e.Fields,
+	}
 }
 
 func (e *errorData) nicelyFormatted() string {
 	str := ""
+	str += "Reference: \n\t" + e.Reference + "\n"
+	str += "Request ID: \n\t" + e.RequestID + "\n"
+	if e.TraceID != "" {
+		str += "Trace ID: \n\t" + e.TraceID + "\n"
+	}
 	str += "Friendly Message: \n\t" + e.Friendly + "\n"
+	if e.FileName == "" {
+		return str // forClient copy without the details
+	}
 	str += "Error: \n\t" + e.Error + "\n"
 	str += "File: \n\t" + e.FileName + ":" + strconv.Itoa(e.LineNumber) + "\n"
 	str += "FunctionName: \n\t" + e.FunctionName + "\n"
 	return str
 }
 
-// errorOut handles error responses in a standardized way
-func errorOut(w http.ResponseWriter, req *http.Request, status int, friendly string, errs ...error) {
+// newErrorData creates a standardized error data structure. The location comes from the errors
+// where they were created with NewError or Trace, otherwise it's the first caller outside mantra
+func newErrorData(req *http.Request, friendly string, errs []error) *errorData {
 	errStr := ""
-	lineNumber := -1
-	funcName := "Not Specified"
-	fileName := "Not Specified"
+	loc := location{line: -1, function: "Not Specified", file: "Not Specified"}
+	var fields FieldErrors
 
 	if len(errs) > 0 {
+		found := false
 		for _, err := range errs {
 			if err != nil {
 				errStr += err.Error() + "\n"
+				if !found {
+					loc, found = locationOf(err)
+				}
+				if fields == nil {
+					errors.As(err, &fields)
+				}
 			} else {
 				errStr += "No Error Specified \n"
 			}
 		}
-		pc, file, line, _ := runtime.Caller(2)
-		lineNumber = line
-		funcName = runtime.FuncForPC(pc).Name()
-		fileName = file
+		if !found {
+			loc = callerOutside()
+		}
+	}
+
+	return &errorData{
+		Reference:    datastore.ULID(),
+		RequestID:    RequestID(req.Context()),
+		TraceID:      TraceID(req.Context()),
+		Friendly:     friendly,
+		Error:        errStr,
+		LineNumber:   loc.line,
+		FunctionName: loc.function,
+		FileName:     loc.file,
+		Fields:       fields,
+	}
+}
+
+// location is where in the code an error came from
+type location struct {
+	file     string
+	line     int
+	function string
+}
+
+// callerOutside finds the first caller that isn't mantra itself, or the runtime when recovering a panic.
+// When that's the server or router calling in, the error was mantra's own and there's no app code to point at
+func callerOutside() location {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "github.com/nerdynz/mantra.") && !strings.HasPrefix(frame.Function, "runtime.") {
+			if servingFrame(frame.Function) {
+				break
+			}
+			return location{frame.File, frame.Line, frame.Function}
+		}
+		if !more {
+			break
+		}
+	}
+	return location{line: -1, function: "Not Specified", file: "Not Specified"}
+}
+
+// servingFrame is the http server or router calling into mantra
+func servingFrame(function string) bool {
+	for _, prefix := range []string{"net/http.", "github.com/go-zoo/bone.", "github.com/urfave/negroni."} {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// tracedError records where an error was passed through Trace
+type tracedError struct {
+	error
+	loc location
+}
+
+func (te *tracedError) Unwrap() error {
+	return te.error
+}
+
+// Trace records where it's called on err, so error responses point there rather than where the error was rendered
+func Trace(err error) error {
+	if err == nil {
+		return nil
 	}
+	return &tracedError{err, callerOutside()}
+}
 
-	data := &errorData{
-		friendly,
-		errStr,
-		lineNumber,
-		funcName,
-		fileName,
+// locationOf finds the location recorded on an error by NewError or Trace
+func locationOf(err error) (location, bool) {
+	var te *tracedError
+	if errors.As(err, &te) {
+		return te.loc, true
+	}
+	var appErr *Error
+	if errors.As(err, &appErr) && appErr.loc.file != "" {
+		return appErr.loc, true
 	}
+	return location{}, false
+}
 
-	slog.Error(data.nicelyFormatted())
+// errorDefaults fills in a 0 status and blank friendly message from the first error
+func errorDefaults(status int, friendly string, errs []error) (int, string) {
+	if len(errs) == 0 || errs[0] == nil {
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		return status, friendly
+	}
+	if status == 0 {
+		status = StatusFor(errs[0])
+	}
+	if friendly == "" {
+		friendly = FriendlyFor(errs[0])
+	}
+	return status, friendly
+}
 
-	w.WriteHeader(status)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(data)
+// errorOut handles error responses in a standardized way, negotiated like ViewBucket.Error
+// but without the renderer, for when there's no store to build a ViewBucket with
+func errorOut(w http.ResponseWriter, req *http.Request, store *datastore.Datastore, status int, friendly string, errs ...error) {
+	status, friendly = errorDefaults(status, friendly, errs)
+	data := newErrorData(req, friendly, errs)
+	slog.ErrorContext(req.Context(), data.nicelyFormatted())
+	data = data.forClient(showErrorDetails(req, store))
+
+	accept := req.Header.Get("Accept")
+	switch {
+	case wantsProblem(req):
+		writeProblem(w, problemFor(req, status, data, errs))
+	case strings.Contains(accept, "text/html"):
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write([]byte("<!DOCTYPE html><title>" + strconv.Itoa(status) + "</title><pre>" + html.EscapeString(data.nicelyFormatted()) + "</pre>"))
+	case strings.Contains(accept, "application/json"):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(data)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write([]byte(data.nicelyFormatted()))
+	}
 }
@@ -0,0 +1,42 @@
+package mantra
+
+import (
+	"log/slog"
+)
+
+const flashCookie = "mantra_flash"
+
+// Flash is a one off notice for the next page shown, e.g. after a redirect
+type Flash struct {
+	Kind    string `json:"k"`
+	Message string `json:"m"`
+}
+
+// Flash queues a notice for the next HTML page, this one if it renders HTML itself.
+// They're in the view data as Flashes until shown
+//
+//	vb.Flash("success", "Saved")
+//	vb.Redirect("/invoices", http.StatusSeeOther)
+func (vb *ViewBucket) Flash(kind string, message string) {
+	vb.flashes = append(vb.flashes, Flash{Kind: kind, Message: message})
+	vb.Add("Flashes", vb.flashes)
+	if err := setSignedCookie(vb.w, vb.req, flashCookie, vb.flashes); err != nil {
+		slog.WarnContext(vb.req.Context(), "mantra: flash message not kept", "error", err)
+	}
+}
+
+// loadFlashes picks up flashes queued on an earlier request
+func (vb *ViewBucket) loadFlashes() {
+	if readSignedCookie(vb.req, flashCookie, &vb.flashes) {
+		vb.Add("Flashes", vb.flashes)
+	}
+}
+
+// flashesShown clears the flashes once a page has displayed them
+func (vb *ViewBucket) flashesShown() {
+	if len(vb.flashes) == 0 {
+		return
+	}
+	clearCookie(vb.w, vb.req, flashCookie)
+	vb.flashes = nil
+}
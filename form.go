@@ -0,0 +1,127 @@
+package mantra
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+const formCookie = "mantra_form"
+
+// formState is what a failed form post carries across the redirect back to the form
+type formState struct {
+	Input    url.Values  `json:"i,omitempty"`
+	Errors   FieldErrors `json:"e,omitempty"`
+	Friendly string      `json:"f,omitempty"`
+}
+
+// FormErrors re-populates the form being rendered from the submitted input and err's field errors, see Validate.
+// Templates read them back with old and fieldError, which take the view data first
+//
+//	<input name="email" value="{{old $ "email"}}"> {{fieldError $ "email"}}
+func (vb *ViewBucket) FormErrors(err error) {
+	vb.addFormState(vb.newFormState(err, nil))
+}
+
+// RedirectWithErrors is FormErrors across a redirect (303) to newUrl, for a POST/redirect/GET.
+// The errors and the input fields listed in keep are held in a signed cookie, which the client can read,
+// until the next HTML render picks them up. Only list fields that are fine to store in the browser
+//
+//	vb.RedirectWithErrors("/signup", err, "name", "email")
+func (vb *ViewBucket) RedirectWithErrors(newUrl string, err error, keep ...string) {
+	if len(keep) == 0 {
+		keep = []string{} // none rather than all
+	}
+	state := vb.newFormState(err, keep)
+	if cookieErr := setSignedCookie(vb.w, vb.req, formCookie, state); cookieErr != nil {
+		state.Input = nil // too much input to carry, the errors matter more
+		if cookieErr = setSignedCookie(vb.w, vb.req, formCookie, state); cookieErr != nil {
+			slog.WarnContext(vb.req.Context(), "mantra: form errors lost on redirect", "error", cookieErr)
+		}
+	}
+	vb.Redirect(newUrl, http.StatusSeeOther)
+}
+
+// RedirectBack is RedirectWithErrors to the page the form was posted from, or / if that's another site
+func (vb *ViewBucket) RedirectBack(err error, keep ...string) {
+	vb.RedirectWithErrors(refererPath(vb.req), err, keep...)
+}
+
+// newFormState collects err's field errors and the submitted input, only the keep fields unless it's nil
+func (vb *ViewBucket) newFormState(err error, keep []string) *formState {
+	state := &formState{Friendly: FriendlyFor(err)}
+	errors.As(err, &state.Errors)
+	if vb.req.Form == nil {
+		vb.req.ParseForm()
+	}
+	state.Input = url.Values{}
+	for key, vals := range vb.req.Form {
+		if sensitiveField(key) || (keep != nil && !slices.Contains(keep, key)) {
+			continue
+		}
+		state.Input[key] = vals
+	}
+	return state
+}
+
+func (vb *ViewBucket) addFormState(state *formState) {
+	vb.Add("OldInput", state.Input)
+	vb.Add("FieldErrors", state.Errors)
+	vb.Add("FormError", state.Friendly)
+}
+
+// loadFormState picks up what RedirectWithErrors left, only once. FormErrors in this request wins
+func (vb *ViewBucket) loadFormState() {
+	var state formState
+	if !readSignedCookie(vb.req, formCookie, &state) {
+		return
+	}
+	clearCookie(vb.w, vb.req, formCookie)
+	if _, ok := vb.data["FieldErrors"]; !ok {
+		vb.addFormState(&state)
+	}
+}
+
+// sensitiveField is never sent back to the browser
+func sensitiveField(name string) bool {
+	name = strings.ToLower(name)
+	return name == CSRFField || strings.Contains(name, "password") || strings.Contains(name, "secret")
+}
+
+func refererPath(req *http.Request) string {
+	ref, err := url.Parse(req.Referer())
+	if err != nil || ref.Path == "" || (ref.Host != "" && ref.Host != req.Host) {
+		return "/"
+	}
+	back := (&url.URL{Path: ref.Path, RawQuery: ref.RawQuery}).String()
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") || strings.HasPrefix(back, "/\\") {
+		return "/" // a browser would take //evil.com or /\evil.com to another site
+	}
+	return back
+}
+
+// old is the submitted value of a form field, {{old $ "email"}}
+func old(data any, name string) string {
+	if input, ok := viewValue(data, "OldInput").(url.Values); ok {
+		return input.Get(name)
+	}
+	return ""
+}
+
+// fieldError is what's wrong with a form field, {{fieldError $ "email"}}
+func fieldError(data any, name string) string {
+	if errs, ok := viewValue(data, "FieldErrors").(FieldErrors); ok {
+		return errs[name]
+	}
+	return ""
+}
+
+func viewValue(data any, key string) any {
+	if m, ok := data.(map[string]interface{}); ok {
+		return m[key]
+	}
+	return nil
+}
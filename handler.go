@@ -0,0 +1,48 @@
+package mantra
+
+import (
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/go-zoo/bone"
+	"github.com/nerdynz/datastore"
+)
+
+// ErrorHandlerFunc is a handler that returns its error rather than rendering it,
+// register it with CustomRouter.Handle or adapt it with HandleErrors
+type ErrorHandlerFunc func(w http.ResponseWriter, req *http.Request, store *datastore.Datastore) error
+
+// HandleErrors adapts fn to a CustomHandlerFunc. A returned error is logged and rendered by
+// ViewBucket.ErrorFrom, pointing at where it was created (see NewError and Trace) or else at fn
+func HandleErrors(fn ErrorHandlerFunc) CustomHandlerFunc {
+	fnLoc := funcLocation(fn)
+	return func(w http.ResponseWriter, req *http.Request, store *datastore.Datastore) {
+		err := fn(w, req, store)
+		if err == nil {
+			return
+		}
+		if _, ok := locationOf(err); !ok {
+			err = &tracedError{err, fnLoc}
+		}
+		view := NewViewBucket(w, req, store)
+		view.ErrorFrom(err)
+	}
+}
+
+// Handle registers an ErrorHandlerFunc for method, e.g. router.Handle("POST", "/invoices", saveInvoice, mantra.SECURE)
+func (customRouter *CustomRouter) Handle(method string, route string, fn ErrorHandlerFunc, securityType AuthMethod, mw ...Middleware) *bone.Route {
+	method = strings.ToUpper(method)
+	return customRouter.Mux.Register(method, customRouter.prefix+route, customRouter.handler(method, route, HandleErrors(fn), securityType, mw...))
+}
+
+func funcLocation(fn any) location {
+	pc := reflect.ValueOf(fn).Pointer()
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return location{line: -1, function: "Not Specified", file: "Not Specified"}
+	}
+	file, line := f.FileLine(pc)
+	return location{file, line, f.Name()}
+}
@@ -0,0 +1,165 @@
+package mantra
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nerdynz/datastore"
+)
+
+// HealthCheck returns an error when a dependency isn't usable
+type HealthCheck func(ctx context.Context) error
+
+type healthCheck struct {
+	name    string
+	timeout time.Duration
+	check   HealthCheck
+}
+
+type healthChecks struct {
+	mu     sync.RWMutex
+	checks []healthCheck
+}
+
+// CheckResult is the outcome of a single check in the /readyz response
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"` // outside production only, it's in the logs either way
+}
+
+// HealthReport is the /healthz and /readyz response
+type HealthReport struct {
+	Status string                  `json:"status"`
+	Checks map[string]*CheckResult `json:"checks,omitempty"`
+}
+
+// DefaultHealthCheckTimeout applies to the datastore checks
+var DefaultHealthCheckTimeout = 2 * time.Second
+
+// AddHealthCheck adds a readiness check, run by /readyz with at most timeout to respond
+func (customRouter *CustomRouter) AddHealthCheck(name string, timeout time.Duration, check HealthCheck) {
+	customRouter.health.mu.Lock()
+	defer customRouter.health.mu.Unlock()
+	customRouter.health.checks = append(customRouter.health.checks, healthCheck{name, timeout, check})
+}
+
+// HealthChecks registers /healthz, which responds while the process is up, and /readyz,
+// which pings postgres, the cache and any checks added with AddHealthCheck. Neither goes through
+// auth, the canonical redirect or middleware, so probes by pod IP see the real status
+func (customRouter *CustomRouter) HealthChecks() {
+	if customRouter.store != nil && customRouter.store.Pool != nil {
+		customRouter.AddHealthCheck("postgres", DefaultHealthCheckTimeout, func(ctx context.Context) error {
+			return customRouter.store.Pool.Ping(ctx)
+		})
+	}
+	if customRouter.store != nil && customRouter.store.Cache != nil {
+		customRouter.AddHealthCheck("cache", DefaultHealthCheckTimeout, func(ctx context.Context) error {
+			return pingCache(ctx, customRouter.store.Cache)
+		})
+	}
+
+	customRouter.probe("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		view := NewViewBucket(w, req, customRouter.store)
+		view.JSON(http.StatusOK, &HealthReport{Status: "ok"})
+	})
+
+	customRouter.probe("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		report := customRouter.health.run(req.Context())
+		status := http.StatusOK
+		if report.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		if store := customRouter.store; store == nil || store.Settings == nil || store.Settings.IsProduction() {
+			for _, result := range report.Checks {
+				result.Error = "" // anyone can read /readyz, errors name hosts, users and databases
+			}
+		}
+		view := NewViewBucket(w, req, customRouter.store)
+		view.JSON(status, report)
+	})
+}
+
+// run runs every check concurrently
+func (hc *healthChecks) run(ctx context.Context) *HealthReport {
+	hc.mu.RLock()
+	checks := append([]healthCheck{}, hc.checks...)
+	hc.mu.RUnlock()
+
+	report := &HealthReport{Status: "ok", Checks: make(map[string]*CheckResult, len(checks))}
+	results := make([]*CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runCheck(ctx, c)
+		}()
+	}
+	wg.Wait()
+
+	for i, c := range checks {
+		report.Checks[c.name] = results[i]
+		if results[i].Status != "ok" {
+			report.Status = "fail"
+		}
+	}
+	return report
+}
+
+func runCheck(ctx context.Context, c healthCheck) *CheckResult {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.check(ctx)
+	}()
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = ctx.Err() // don't wait on checks ignoring their context
+	}
+
+	result := &CheckResult{
+		Status:    "ok",
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Health check failed", "check", c.name, "error", err)
+		result.Status = "fail"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// pingCache uses the caches own Ping if it has one, otherwise a set and get round trip
+func pingCache(ctx context.Context, cache datastore.Cache) error {
+	switch c := cache.(type) {
+	case interface{ Ping(context.Context) error }:
+		return c.Ping(ctx)
+	case interface{ Ping() error }:
+		return c.Ping()
+	}
+	key := "mantra:readyz:" + datastore.ULID()
+	if err := cache.Set(key, "ok", 10*time.Second); err != nil {
+		return err
+	}
+	val, err := cache.Get(key)
+	if err != nil {
+		return err
+	}
+	if val != "ok" {
+		return errors.New("cache returned " + val + " for the readyz key")
+	}
+	return cache.Del(key)
+}
@@ -29,6 +29,10 @@ var helperFuncs = template.FuncMap{
 	"title": title,
 	"year":  year,
 	// "getPartialName": getPartialName,
+	"old":              old,
+	"fieldError":       fieldError,
+	"csrfField":        csrfField,
+	"csrfToken":        csrfToken,
 	"hasValue":         hasValue,
 	"isBlank":          isBlank,
 	"isNotBlank":       isNotBlank,
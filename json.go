@@ -0,0 +1,77 @@
+package mantra
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/nerdynz/datastore"
+)
+
+// MaxJSONBodyBytes limits the request bodies JSONHandler decodes
+var MaxJSONBodyBytes int64 = 1 << 20
+
+// JSONHandler adapts fn to a CustomHandlerFunc for JSON endpoints. The request body is decoded into Req,
+// rejecting unknown fields and bodies over MaxJSONBodyBytes, and checked with Validate. The Resp fn returns is encoded as the response.
+// A returned error is mapped to a status (see StatusFor) and rendered as JSON
+//
+//	router.POST("/api/invoices", mantra.JSONHandler(saveInvoice), mantra.SECURE)
+func JSONHandler[Req any, Resp any](fn func(ctx context.Context, store *datastore.Datastore, req Req) (Resp, error)) CustomHandlerFunc {
+	fnLoc := funcLocation(fn)
+	return func(w http.ResponseWriter, req *http.Request, store *datastore.Datastore) {
+		var in Req
+		err := DecodeJSON(w, req, &in)
+		if err == nil {
+			err = Validate(&in)
+		}
+		if err != nil {
+			err = &tracedError{err, fnLoc} // the decode or validation error was created in here, point at the handler
+		} else {
+			var out Resp
+			out, err = fn(req.Context(), store, in)
+			if err == nil {
+				view := NewViewBucket(w, req, store)
+				view.JSON(http.StatusOK, out)
+				return
+			}
+			if _, ok := locationOf(err); !ok {
+				err = &tracedError{err, fnLoc}
+			}
+		}
+
+		status, friendly := errorDefaults(0, "", []error{err})
+		view := NewViewBucket(w, req, store)
+		if wantsProblem(req) {
+			view.ErrorProblem(status, friendly, err)
+			return
+		}
+		view.ErrorJSON(status, friendly, err)
+	}
+}
+
+// DecodeJSON decodes the request body into dst the way JSONHandler does, an empty body leaves dst alone
+func DecodeJSON(w http.ResponseWriter, req *http.Request, dst any) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, MaxJSONBodyBytes))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(dst)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return NewError(CodeTooLarge, "Request body is larger than "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes", err)
+		}
+		return BadRequest("Invalid JSON", err)
+	}
+	if dec.More() {
+		return BadRequest("Invalid JSON", errors.New("unexpected data after the JSON body"))
+	}
+	return nil
+}
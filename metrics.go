@@ -0,0 +1,165 @@
+package mantra
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/twitchtv/twirp"
+	"github.com/urfave/negroni"
+)
+
+// Metrics collects prometheus metrics for http requests and twirp methods.
+// Add it to New with WithMetrics, to twirp servers with ServerHooks and serve it with CustomRouter.Metrics
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	size     *prometheus.HistogramVec
+	inFlight prometheus.Gauge
+
+	twirpRequests *prometheus.CounterVec
+	twirpDuration *prometheus.HistogramVec
+}
+
+var requestLabels = []string{"route", "method", "status", "auth"}
+
+// NewMetrics creates the collectors in their own registry, along with the go runtime and process collectors
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mantra_http_requests_total",
+			Help: "HTTP requests by route pattern, method, status and auth method.",
+		}, requestLabels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mantra_http_request_duration_seconds",
+			Help:    "HTTP request durations by route pattern, method, status and auth method.",
+			Buckets: prometheus.DefBuckets,
+		}, requestLabels),
+		size: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mantra_http_response_size_bytes",
+			Help:    "HTTP response body sizes by route pattern, method, status and auth method.",
+			Buckets: prometheus.ExponentialBuckets(100, 10, 7),
+		}, requestLabels),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mantra_http_requests_in_flight",
+			Help: "HTTP requests currently being served.",
+		}),
+		twirpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mantra_twirp_requests_total",
+			Help: "Twirp requests by service, method and error code (ok when successful).",
+		}, []string{"service", "method", "code"}),
+		twirpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mantra_twirp_request_duration_seconds",
+			Help:    "Twirp request durations by service and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"service", "method"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.duration, m.size, m.inFlight,
+		m.twirpRequests, m.twirpDuration,
+	)
+	return m
+}
+
+// Registry is where the collectors are registered, add app specific collectors to it
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler serves the metrics in the prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware records every request, labelled by route pattern rather than path to keep cardinality down
+func (m *Metrics) Middleware() negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		start := time.Now()
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		req, info := ensureRequestInfo(req)
+		nw, ok := w.(negroni.ResponseWriter)
+		if !ok {
+			nw = negroni.NewResponseWriter(w)
+		}
+
+		next(nw, req)
+
+		status := nw.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := info.route
+		if route == "" {
+			route = "unmatched"
+		}
+		labels := prometheus.Labels{
+			"route":  route,
+			"method": req.Method,
+			"status": strconv.Itoa(status),
+			"auth":   string(info.authMethod),
+		}
+		m.requests.With(labels).Inc()
+		m.duration.With(labels).Observe(time.Since(start).Seconds())
+		m.size.With(labels).Observe(float64(nw.Size()))
+	}
+}
+
+type twirpCallKey struct{}
+
+type twirpCall struct {
+	start time.Time
+	code  twirp.ErrorCode
+}
+
+// ServerHooks records twirp method calls and error codes, chain with other hooks via twirp.ChainHooks
+func (m *Metrics) ServerHooks() *twirp.ServerHooks {
+	return &twirp.ServerHooks{
+		RequestReceived: func(ctx context.Context) (context.Context, error) {
+			return context.WithValue(ctx, twirpCallKey{}, &twirpCall{start: time.Now()}), nil
+		},
+		Error: func(ctx context.Context, err twirp.Error) context.Context {
+			if call, ok := ctx.Value(twirpCallKey{}).(*twirpCall); ok {
+				call.code = err.Code()
+			}
+			return ctx
+		},
+		ResponseSent: func(ctx context.Context) {
+			call, ok := ctx.Value(twirpCallKey{}).(*twirpCall)
+			if !ok {
+				return
+			}
+			service, _ := twirp.ServiceName(ctx)
+			method, _ := twirp.MethodName(ctx)
+			code := "ok"
+			if call.code != "" {
+				code = string(call.code)
+			}
+			m.twirpRequests.WithLabelValues(service, method, code).Inc()
+			m.twirpDuration.WithLabelValues(service, method).Observe(time.Since(call.start).Seconds())
+		},
+	}
+}
+
+// WithMetrics adds the metrics middleware to New
+func WithMetrics(m *Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// Metrics registers GET /metrics serving m. It skips auth, the canonical redirect and middleware
+// so a scrape by pod IP reads that instance
+func (customRouter *CustomRouter) Metrics(m *Metrics) {
+	customRouter.probe("/metrics", m.Handler().ServeHTTP)
+}
@@ -0,0 +1,25 @@
+package mantra
+
+import "net/http"
+
+// Middleware wraps a CustomHandlerFunc. Route middleware runs after authentication,
+// so it only ever sees requests the routes AuthMethod has allowed through
+type Middleware func(next CustomHandlerFunc) CustomHandlerFunc
+
+// HTTPMiddleware wraps a plain http.Handler, e.g. gzip or rate limiting. Given to Group it runs
+// before authentication, so it sees every request to the group, including ones about to be rejected.
+// The order for a route is Group HTTPMiddleware, authentication, then Use and route Middleware
+type HTTPMiddleware func(next http.Handler) http.Handler
+
+// Chain wraps fn in mw, the first middleware is the outermost
+func Chain(fn CustomHandlerFunc, mw ...Middleware) CustomHandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		fn = mw[i](fn)
+	}
+	return fn
+}
+
+// Use adds route middleware to every route registered on this router (or group) from now on
+func (customRouter *CustomRouter) Use(mw ...Middleware) {
+	customRouter.routeMiddleware = append(customRouter.routeMiddleware, mw...)
+}
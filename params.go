@@ -84,27 +84,31 @@ func ShortDateParam(req *http.Request, key string) (time.Time, error) {
 
 // BoolParam gets a boolean parameter with multiple truthy values
 func BoolParam(req *http.Request, key string) bool {
-	val := Param(req, key)
+	b, _ := parseBool(Param(req, key))
+	return b
+}
+
+// parseBool understands the truthy values BoolParam accepts as well as strconv.ParseBool
+func parseBool(val string) (bool, error) {
 	if val == "true" {
-		return true
+		return true, nil
 	}
 	if val == "yes" {
-		return true
+		return true, nil
 	}
 	if val == "1" {
-		return true
+		return true, nil
 	}
 	if val == "y" {
-		return true
+		return true, nil
 	}
 	if val == "✓" {
-		return true
+		return true, nil
 	}
-	b, err := strconv.ParseBool(val)
-	if err != nil {
-		return false
+	if val == "no" || val == "n" {
+		return false, nil
 	}
-	return b
+	return strconv.ParseBool(val)
 }
 
 // IntParamWithDefault gets an integer parameter with a default value
@@ -0,0 +1,120 @@
+package mantra
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/nerdynz/datastore"
+	"github.com/nerdynz/security"
+)
+
+// Policy decides if the logged in user may access a route or twirp service, return an error to deny.
+// user is nil when nobody is logged in
+type Policy func(ctx context.Context, user *security.SessionUser) error
+
+var errNotLoggedIn = errors.New("not logged in")
+
+// RequireRole allows users with any of the given roles
+func RequireRole(roles ...string) Policy {
+	return func(ctx context.Context, user *security.SessionUser) error {
+		if user == nil {
+			return errNotLoggedIn
+		}
+		for _, role := range roles {
+			if strings.EqualFold(user.Role, role) {
+				return nil
+			}
+		}
+		return errors.New("requires role " + strings.Join(roles, " or "))
+	}
+}
+
+// RequirePermission allows users holding all of the given permissions, see AddRolePermissions
+func RequirePermission(permissions ...string) Policy {
+	return func(ctx context.Context, user *security.SessionUser) error {
+		if user == nil {
+			return errNotLoggedIn
+		}
+		granted := PermissionsFor(ctx, user)
+		for _, permission := range permissions {
+			if !hasPermission(granted, permission) {
+				return errors.New("requires permission " + permission)
+			}
+		}
+		return nil
+	}
+}
+
+// Require allows users for which fn returns true, reason is used as the error when it doesn't
+func Require(reason string, fn func(ctx context.Context, user *security.SessionUser) bool) Policy {
+	return func(ctx context.Context, user *security.SessionUser) error {
+		if user == nil {
+			return errNotLoggedIn
+		}
+		if !fn(ctx, user) {
+			return errors.New(reason)
+		}
+		return nil
+	}
+}
+
+var (
+	rolePermissionsMu sync.RWMutex
+	rolePermissions   = map[string][]string{}
+)
+
+// AddRolePermissions grants permissions to every user with role. A permission of "invoices:*"
+// grants everything under invoices, "*" grants everything
+func AddRolePermissions(role string, permissions ...string) {
+	rolePermissionsMu.Lock()
+	defer rolePermissionsMu.Unlock()
+	role = strings.ToLower(role)
+	rolePermissions[role] = append(rolePermissions[role], permissions...)
+}
+
+// PermissionsFor resolves the permissions of a user, by default from AddRolePermissions.
+// Replace it to load permissions from somewhere else
+var PermissionsFor = func(ctx context.Context, user *security.SessionUser) []string {
+	rolePermissionsMu.RLock()
+	defer rolePermissionsMu.RUnlock()
+	return rolePermissions[strings.ToLower(user.Role)]
+}
+
+func hasPermission(granted []string, permission string) bool {
+	for _, g := range granted {
+		if g == "*" || g == permission {
+			return true
+		}
+		if strings.HasSuffix(g, ":*") && strings.HasPrefix(permission, strings.TrimSuffix(g, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkPolicies(ctx context.Context, policies []Policy) error {
+	user := CurrentUser(ctx)
+	for _, policy := range policies {
+		if err := policy(ctx, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Authorize is route middleware that responds 403 unless every policy passes
+func Authorize(policies ...Policy) Middleware {
+	return func(next CustomHandlerFunc) CustomHandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request, store *datastore.Datastore) {
+			if err := checkPolicies(req.Context(), policies); err != nil {
+				view := NewViewBucket(w, req, store)
+				view.Error(http.StatusForbidden, "You don't have permission to do that", err)
+				return
+			}
+			next(w, req, store)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package mantra
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ContentProblemJSON is the RFC 7807 content type
+const ContentProblemJSON = "application/problem+json"
+
+// PreferProblemJSON sends problem+json errors to clients accepting application/json too,
+// not just those asking for application/problem+json
+var PreferProblemJSON = false
+
+// Problem is an RFC 7807 problem detail. Pass one to ViewBucket.Error to control the problem+json response,
+// members it doesn't set are filled in from the request
+type Problem struct {
+	Type     string
+	Title    string
+	Status   int
+	Detail   string
+	Instance string
+
+	// Extensions are extra members, e.g. "balance": 30
+	Extensions map[string]any
+}
+
+// NewProblem creates a problem, title is a short human readable summary of the problem type
+func NewProblem(status int, title string) *Problem {
+	return &Problem{
+		Status: status,
+		Title:  title,
+	}
+}
+
+// With adds an extension member
+func (p *Problem) With(key string, value any) *Problem {
+	if p.Extensions == nil {
+		p.Extensions = map[string]any{}
+	}
+	p.Extensions[key] = value
+	return p
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Title + ": " + p.Detail
+	}
+	return p.Title
+}
+
+// MarshalJSON flattens the extension members in with the standard ones
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	m := make(map[string]any, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		m[k] = v
+	}
+	m["type"] = p.Type
+	if p.Type == "" {
+		m["type"] = "about:blank"
+	}
+	m["title"] = p.Title
+	m["status"] = p.Status
+	if p.Detail != "" {
+		m["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		m["instance"] = p.Instance
+	}
+	return json.Marshal(m)
+}
+
+// FieldErrors maps a field name to what's wrong with it, sent as the "errors" member of a problem
+type FieldErrors map[string]string
+
+func (fe FieldErrors) Error() string {
+	fields := make([]string, 0, len(fe))
+	for field, msg := range fe {
+		fields = append(fields, field+": "+msg)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ", ")
+}
+
+// wantsProblem checks the Accept header for problem+json
+func wantsProblem(req *http.Request) bool {
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, ContentProblemJSON) || (PreferProblemJSON && strings.Contains(accept, "application/json"))
+}
+
+// problemFor builds the problem for an error response, starting from any Problem in errs
+func problemFor(req *http.Request, status int, data *errorData, errs []error) *Problem {
+	problem := &Problem{}
+	var fieldErrs FieldErrors
+	var appErr *Error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		var p *Problem
+		if errors.As(err, &p) {
+			copied := *p
+			copied.Extensions = maps.Clone(p.Extensions) // we add to them below
+			problem = &copied
+		}
+		errors.As(err, &fieldErrs)
+		errors.As(err, &appErr)
+	}
+
+	problem.Status = status
+	if problem.Title == "" {
+		problem.Title = data.Friendly
+	}
+	if problem.Title == "" {
+		problem.Title = http.StatusText(status)
+	}
+	if problem.Detail == "" {
+		problem.Detail = strings.TrimSpace(data.Error) // blank unless the details are shown
+	}
+	if problem.Instance == "" {
+		problem.Instance = req.URL.Path
+	}
+	problem.With("reference", data.Reference)
+	if data.RequestID != "" {
+		problem.With("request_id", data.RequestID)
+	}
+	if data.TraceID != "" {
+		problem.With("trace_id", data.TraceID)
+	}
+	if appErr != nil {
+		problem.With("code", appErr.Code)
+	}
+	if len(fieldErrs) > 0 {
+		problem.With("errors", fieldErrs)
+	}
+	return problem
+}
+
+func writeProblem(w http.ResponseWriter, problem *Problem) {
+	w.Header().Set("Content-Type", ContentProblemJSON)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
@@ -0,0 +1,90 @@
+package mantra
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"github.com/nerdynz/datastore"
+	"github.com/twitchtv/twirp"
+	"github.com/urfave/negroni"
+)
+
+var (
+	twirpPrefixesMu sync.RWMutex
+	twirpPrefixes   []string
+)
+
+// addTwirpPrefix remembers a twirp service path, so errors outside the router can respond as twirp errors
+func addTwirpPrefix(prefix string) {
+	twirpPrefixesMu.Lock()
+	defer twirpPrefixesMu.Unlock()
+	twirpPrefixes = append(twirpPrefixes, strings.ToLower(prefix))
+}
+
+func isTwirpRequest(req *http.Request) bool {
+	path := strings.ToLower(req.URL.Path)
+	twirpPrefixesMu.RLock()
+	defer twirpPrefixesMu.RUnlock()
+	for _, prefix := range twirpPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Recovery is middleware that logs panics with their stack and responds with a twirp.Internal error
+// for twirp services, otherwise ViewBucket.Error, or the same negotiated response without templates when
+// there's no store.
+// Panic details are hidden from clients in production
+func Recovery(store *datastore.Datastore) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p) // the server handles this one quietly
+			}
+
+			stack := debug.Stack()
+			slog.ErrorContext(req.Context(), "Panic", "error", fmt.Sprint(p), "method", req.Method, "path", req.URL.Path, "stack", string(stack))
+
+			if nw, ok := w.(negroni.ResponseWriter); ok && nw.Written() {
+				return // too late to send anything useful
+			}
+
+			if isTwirpRequest(req) {
+				msg := "internal error"
+				if showErrorDetails(req, store) {
+					msg = fmt.Sprintf("panic: %v", p)
+				}
+				twirp.WriteError(w, twirp.InternalError(msg))
+				return
+			}
+
+			err := fmt.Errorf("panic: %v\n%s", p, stack)
+			if store == nil {
+				errorOut(w, req, nil, http.StatusInternalServerError, "Something went wrong", err) // no templates without WithStore
+				return
+			}
+			// ViewBucket hides the details in production
+			view := NewViewBucket(w, req, store)
+			view.Error(http.StatusInternalServerError, "Something went wrong", err)
+		}()
+
+		next(w, req)
+	}
+}
+
+// WithStore gives the middleware New adds access to the datastore, used to render errors and check the environment
+func WithStore(store *datastore.Datastore) Option {
+	return func(o *options) {
+		o.store = store
+	}
+}
@@ -0,0 +1,73 @@
+package mantra
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/nerdynz/datastore"
+	"github.com/urfave/negroni"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader is read for an incoming request id and set on every response
+const RequestIDHeader = "X-Request-ID"
+
+// RequestIDs is middleware giving every request an id, the incoming X-Request-ID if it's sane
+// otherwise a new ULID. The id is echoed in the response headers and available via RequestID(ctx).
+// It's only added to log records by a NewContextHandler, see New
+func RequestIDs() negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = datastore.ULID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next(w, req.WithContext(withRequestID(req.Context(), id)))
+	}
+}
+
+// validRequestID stops clients putting anything nasty in our logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// contextHandler adds the request and trace ids to records logged with a request context
+type contextHandler struct {
+	slog.Handler
+}
+
+// NewContextHandler wraps h so records logged with a request context (slog.InfoContext etc) include its request_id and trace_id.
+// h is returned as is when it's already wrapped
+func NewContextHandler(h slog.Handler) slog.Handler {
+	if _, ok := h.(*contextHandler); ok {
+		return h
+	}
+	return &contextHandler{h}
+}
+
+func (ch *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		record.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return ch.Handler.Handle(ctx, record)
+}
+
+func (ch *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{ch.Handler.WithAttrs(attrs)}
+}
+
+func (ch *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{ch.Handler.WithGroup(name)}
+}
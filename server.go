@@ -0,0 +1,102 @@
+package mantra
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nerdynz/datastore"
+	"github.com/urfave/negroni"
+)
+
+// Server runs a mantra app until it's signalled, then drains in flight requests and closes the datastore
+type Server struct {
+	*http.Server
+	Store *datastore.Datastore
+
+	// DrainTimeout is how long in flight requests get to finish after SIGINT/SIGTERM
+	DrainTimeout time.Duration
+}
+
+// NewServer wires the router into n and returns a server listening on addr with sane timeouts.
+// WriteTimeout must be longer than the slowest route, raise it for long running exports
+func NewServer(addr string, n *negroni.Negroni, router *CustomRouter) *Server {
+	n.UseHandler(router.Mux)
+	return &Server{
+		Server: &http.Server{
+			Addr:              addr,
+			Handler:           n,
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      2 * time.Minute,
+			IdleTimeout:       2 * time.Minute,
+		},
+		Store:        router.store,
+		DrainTimeout: 30 * time.Second,
+	}
+}
+
+// Serve is shorthand for NewServer(addr, n, router).ListenAndServe()
+func Serve(addr string, n *negroni.Negroni, router *CustomRouter) error {
+	return NewServer(addr, n, router).ListenAndServe()
+}
+
+// ListenAndServe blocks until SIGINT or SIGTERM
+func (s *Server) ListenAndServe() error {
+	return s.Run(context.Background())
+}
+
+// Run blocks until ctx is done or SIGINT/SIGTERM is received, then shuts down gracefully
+func (s *Server) Run(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		slog.Info("Server", "listening on", s.Addr)
+		errs <- s.Server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		s.closeStore()
+		return err
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the process as usual
+
+	slog.Info("Server", "shutting down, draining for", s.DrainTimeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+	defer cancel()
+	err := s.Shutdown(drainCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("Server", "drain timed out, closing", s.Addr)
+		err = s.Close()
+	}
+	s.closeStore()
+	if err != nil {
+		return err
+	}
+	slog.Info("Server", "stopped", s.Addr)
+	return nil
+}
+
+func (s *Server) closeStore() {
+	if s.Store == nil {
+		return
+	}
+	if s.Store.Pool != nil {
+		s.Store.Pool.Close()
+	}
+	if closer, ok := s.Store.Cache.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			slog.Error("Server", "closing cache", err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package mantra
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nerdynz/datastore"
+	"github.com/twitchtv/twirp"
+)
+
+// DefaultTimeout applies to authenticated twirp services registered without WithTimeout,
+// OPEN and TODO services have no timeout unless they ask for one
+var DefaultTimeout = 20 * time.Second
+
+// WithTimeout sets how long the twirp service has to respond, 0 for no timeout.
+// Timed out requests get a twirp.DeadlineExceeded error
+func WithTimeout(d time.Duration) TwirpOption {
+	return func(reg *twirpRegistration) {
+		reg.timeout = &d
+	}
+}
+
+// Timeout is route middleware giving the handler d to respond, timed out requests
+// get a 504 rendered through ViewBucket.Error
+func Timeout(d time.Duration) Middleware {
+	return func(next CustomHandlerFunc) CustomHandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request, store *datastore.Datastore) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				next(w, req, store)
+			})
+			timeoutHandler(h, d, func(w http.ResponseWriter, req *http.Request) {
+				err := NewError(CodeTimeout, "Request timed out", errors.New("timed out after "+d.String()))
+				err.loc = funcLocation(next) // it's the handler that was too slow, not whatever called this
+				view := NewViewBucket(w, req, store)
+				view.ErrorFrom(err)
+			}).ServeHTTP(w, req)
+		}
+	}
+}
+
+func twirpTimeout(h http.Handler, d time.Duration) http.Handler {
+	return timeoutHandler(h, d, func(w http.ResponseWriter, req *http.Request) {
+		twirp.WriteError(w, twirp.NewError(twirp.DeadlineExceeded, "request timed out"))
+	})
+}
+
+// timeoutHandler works like http.TimeoutHandler but lets the caller render the timeout
+func timeoutHandler(h http.Handler, d time.Duration, onTimeout func(w http.ResponseWriter, req *http.Request)) http.Handler {
+	if d <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		defer cancel()
+		req = req.WithContext(ctx)
+
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		tw := &timeoutWriter{header: make(http.Header)}
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			h.ServeHTTP(tw, req)
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			dst := w.Header()
+			for k, vv := range tw.header {
+				dst[k] = vv
+			}
+			if tw.code == 0 {
+				tw.code = http.StatusOK
+			}
+			w.WriteHeader(tw.code)
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				onTimeout(w, req)
+			}
+		}
+	})
+}
+
+// timeoutWriter buffers the response so nothing is sent if the handler times out
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	code     int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.code == 0 {
+		tw.code = http.StatusOK
+	}
+	return tw.buf.Write(b)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.code != 0 {
+		return
+	}
+	tw.code = code
+}
@@ -0,0 +1,111 @@
+package mantra
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/urfave/negroni"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/nerdynz/mantra"
+
+// TracerProvider creates mantras spans, nil uses the global otel provider. In tests set it to an
+// sdktrace.TracerProvider with a tracetest.InMemoryExporter to inspect the spans, see tracing_test.go
+var TracerProvider trace.TracerProvider
+
+// Propagator reads the parent span from incoming requests, W3C traceparent and baggage by default
+var Propagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+func tracer() trace.Tracer {
+	if TracerProvider != nil {
+		return TracerProvider.Tracer(tracerName)
+	}
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// TraceID returns the trace id of the current span, blank when not tracing
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// Tracing is middleware starting the server span for every request, continuing any trace the client sent.
+// New adds it ahead of the access log so the log line carries the trace id. The span is named after
+// the route and gets the user and site once the router has matched and authenticated the request
+func Tracing() negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		serveTraced(w, req, "", next)
+	}
+}
+
+// traced wraps h in a server span for route (the path when blank), unless Tracing already started one
+func traced(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req = ensureRequestID(req)
+		// already traced by an outer mantra handler, e.g. Tracing or WithAuthorization inside CustomRouter.Twirp
+		if req.Context().Value(tracedKey) != nil {
+			h.ServeHTTP(w, req)
+			return
+		}
+		serveTraced(w, req, route, h)
+	})
+}
+
+func serveTraced(w http.ResponseWriter, req *http.Request, route string, h http.Handler) {
+	ctx := Propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	ctx, span := tracer().Start(ctx, req.Method+" "+req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.path", req.URL.Path),
+		),
+	)
+	defer span.End()
+	if id := RequestID(ctx); id != "" {
+		span.SetAttributes(attribute.String("mantra.request_id", id))
+	}
+
+	ctx = context.WithValue(ctx, tracedKey, true)
+	req, info := ensureRequestInfo(req.WithContext(ctx))
+	nw, ok := w.(negroni.ResponseWriter)
+	if !ok {
+		nw = negroni.NewResponseWriter(w)
+	}
+
+	h.ServeHTTP(nw, req)
+
+	if info.route != "" {
+		route = info.route
+	}
+	if route != "" {
+		span.SetName(req.Method + " " + route)
+		span.SetAttributes(attribute.String("http.route", route))
+	}
+	status := nw.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	if info.user != nil {
+		span.SetAttributes(
+			attribute.String("enduser.id", info.user.ULID),
+			attribute.String("mantra.site_ulid", info.user.SiteULID),
+		)
+	}
+}
+
+// startSpan starts a child span of the request, for work inside a handler
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
@@ -0,0 +1,79 @@
+package mantra
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nerdynz/datastore"
+	"github.com/nerdynz/security"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	withTemplates(t)
+	exporter := tracetest.NewInMemoryExporter()
+	TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { TracerProvider = nil })
+
+	var logs bytes.Buffer
+	n := New(slog.New(NewContextHandler(slog.NewJSONHandler(&logs, nil))))
+	router := Router(&datastore.Datastore{Settings: testSettings{}})
+	login := func(next CustomHandlerFunc) CustomHandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request, store *datastore.Datastore) {
+			user := &security.SessionUser{ULID: "user-1", SiteULID: "site-1"}
+			next(w, req.WithContext(withLogin(req.Context(), user, "token")), store)
+		}
+	}
+	router.GET("/invoices/:id", func(w http.ResponseWriter, req *http.Request, store *datastore.Datastore) {
+		view := NewViewBucket(w, req, store)
+		view.Add("Title", "Invoice")
+		view.HTML(http.StatusOK, "page")
+	}, OPEN, login)
+	n.UseHandler(router.Mux)
+
+	w := httptest.NewRecorder()
+	n.ServeHTTP(w, httptest.NewRequest("GET", "/invoices/42", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("want a server and a render span, got %d", len(spans))
+	}
+	render, server := spans[0], spans[1]
+	if server.Name != "GET /invoices/:id" {
+		t.Errorf("server span named %q", server.Name)
+	}
+	wantAttr(t, server.Attributes, "http.route", "/invoices/:id")
+	wantAttr(t, server.Attributes, "enduser.id", "user-1")
+	wantAttr(t, server.Attributes, "mantra.site_ulid", "site-1")
+	if render.Name != "render page" || render.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("render span %q isn't a child of the server span", render.Name)
+	}
+	wantAttr(t, render.Attributes, "mantra.template", "page")
+
+	traceID := server.SpanContext.TraceID().String()
+	if !strings.Contains(logs.String(), `"trace_id":"`+traceID+`"`) {
+		t.Errorf("access log is missing trace id %s: %s", traceID, logs.String())
+	}
+}
+
+func wantAttr(t *testing.T, attrs []attribute.KeyValue, key string, want string) {
+	t.Helper()
+	for _, attr := range attrs {
+		if string(attr.Key) == key {
+			if got := attr.Value.Emit(); got != want {
+				t.Errorf("%s = %q, want %q", key, got, want)
+			}
+			return
+		}
+	}
+	t.Errorf("missing attribute %s", key)
+}
@@ -0,0 +1,100 @@
+package mantra
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/nerdynz/datastore"
+	"github.com/twitchtv/twirp"
+)
+
+// TwirpAuth holds auth requirements per twirp method name. It's enforced by its ServerHooks,
+// so pass those to the generated server and register the server with WithMethodAuth
+//
+//	methods := mantra.NewTwirpAuth().Method("Login", mantra.OPEN).Method("Delete", mantra.SECURE, mantra.RequireRole("admin"))
+//	server := pb.NewUserServer(impl, twirp.WithServerHooks(methods.ServerHooks()))
+//	router.Twirp(server, mantra.SECURE, mantra.WithMethodAuth(methods))
+type TwirpAuth struct {
+	store         *datastore.Datastore
+	defaultMethod AuthMethod
+	policies      []Policy // from WithPolicy, apply to every method
+	methods       map[string]methodAuth
+	hooked        bool                        // ServerHooks was called, without them nothing is enforced
+	resolveAuth   func(AuthMethod) AuthMethod // the groups, so a method can't be less strict than it
+}
+
+type methodAuth struct {
+	authMethod AuthMethod
+	policies   []Policy
+}
+
+// NewTwirpAuth creates an empty TwirpAuth, methods not listed use the AuthMethod the service is registered with
+func NewTwirpAuth() *TwirpAuth {
+	return &TwirpAuth{
+		defaultMethod: SECURE,
+		methods:       map[string]methodAuth{},
+	}
+}
+
+// Method sets the auth requirement of a single method, name is the method name as in the protobuf service.
+// Inside a group the method is at least as strict as the group, like any other route
+func (ta *TwirpAuth) Method(name string, authMethod AuthMethod, policies ...Policy) *TwirpAuth {
+	ta.methods[name] = methodAuth{authMethod, policies}
+	return ta
+}
+
+// ServerHooks returns the hooks enforcing the auth requirements, chain with other hooks via twirp.ChainHooks
+func (ta *TwirpAuth) ServerHooks() *twirp.ServerHooks {
+	ta.hooked = true
+	return &twirp.ServerHooks{
+		RequestRouted: ta.requestRouted,
+	}
+}
+
+func (ta *TwirpAuth) requestRouted(ctx context.Context) (context.Context, error) {
+	name, _ := twirp.MethodName(ctx)
+	rule, ok := ta.methods[name]
+	if !ok {
+		rule = methodAuth{authMethod: ta.defaultMethod}
+	}
+	if ta.resolveAuth != nil {
+		rule.authMethod = ta.resolveAuth(rule.authMethod)
+	}
+	policies := append(append([]Policy{}, ta.policies...), rule.policies...)
+
+	if rule.authMethod == OPEN && len(policies) == 0 {
+		return ctx, nil
+	}
+	if rule.authMethod == TODO && ta.store != nil && ta.store.Settings.IsDevelopment() {
+		slog.Warn("Twirp", "method marked as TODO", name)
+		return ctx, nil
+	}
+
+	req, ok := ctx.Value(requestKey).(*http.Request)
+	if !ok {
+		return ctx, twirp.InternalError("twirp service not registered with mantra.WithMethodAuth")
+	}
+	ctx, twerr := authorizeTwirp(ctx, req, policies)
+	if twerr != nil {
+		return ctx, twerr
+	}
+	return ctx, nil
+}
+
+// WithMethodAuth hands auth over to the TwirpAuth hooks. The AuthMethod the service is
+// registered with applies to methods the TwirpAuth doesn't list. Registering panics if
+// ServerHooks hasn't been called yet, the service would have no auth at all
+func WithMethodAuth(ta *TwirpAuth) TwirpOption {
+	return func(reg *twirpRegistration) {
+		reg.methodAuth = ta
+	}
+}
+
+// withRequest makes the request available to the TwirpAuth hooks, which only get a context
+func withRequest(base http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = ensureRequestID(r)
+		base.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestKey, r)))
+	})
+}
@@ -0,0 +1,143 @@
+package mantra
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nerdynz/datastore"
+	"github.com/nerdynz/security"
+	"github.com/twitchtv/twirp"
+	"github.com/twitchtv/twirp/ctxsetters"
+)
+
+// testTwirpServer stands in for a generated server, running its hooks with the method named in the url.
+// Like a generated server the name is the one from the proto, not the (lowercased by the router) path
+type testTwirpServer struct {
+	prefix string
+	hooks  *twirp.ServerHooks
+}
+
+var testTwirpMethods = []string{"Login", "List", "Delete"}
+
+func (s *testTwirpServer) PathPrefix() string {
+	return s.prefix
+}
+
+func (s *testTwirpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	method := strings.TrimPrefix(req.URL.Path, s.prefix)
+	i := slices.IndexFunc(testTwirpMethods, func(name string) bool { return strings.EqualFold(name, method) })
+	if i < 0 {
+		twirp.WriteError(w, twirp.NewError(twirp.BadRoute, "no such method"))
+		return
+	}
+	ctx := ctxsetters.WithMethodName(req.Context(), testTwirpMethods[i])
+	if s.hooks != nil && s.hooks.RequestRouted != nil {
+		if _, err := s.hooks.RequestRouted(ctx); err != nil {
+			twirp.WriteError(w, err)
+			return
+		}
+	}
+	io.WriteString(w, "{}")
+}
+
+// testKey logs in the "admin" and "user" tokens, sent as Basic auth
+type testKey struct {
+	security.Key
+}
+
+func (testKey) GetAuthToken(req *http.Request) (string, error) {
+	return "", nil
+}
+
+func (testKey) GetLogin(token string) (*security.SessionInfo, error) {
+	if token != "admin" && token != "user" {
+		return nil, errors.New("not logged in")
+	}
+	return &security.SessionInfo{User: &security.SessionUser{ULID: token + "-1", SiteULID: "site-1", Role: token}}, nil
+}
+
+func TestTwirpAuth(t *testing.T) {
+	security.RegisterKey(testKey{})
+	t.Cleanup(func() { security.RegisterKey(nil) })
+
+	methods := NewTwirpAuth().
+		Method("Login", OPEN).
+		Method("Delete", SECURE, RequireRole("admin"))
+	server := &testTwirpServer{prefix: "/twirp/twirpauthtest.invoices/", hooks: methods.ServerHooks()}
+	router := Router(&datastore.Datastore{Settings: testSettings{}})
+	router.Twirp(server, SECURE, WithMethodAuth(methods))
+
+	tests := []struct {
+		method string
+		token  string
+		want   int
+	}{
+		{"Login", "", http.StatusOK},
+		{"List", "", http.StatusUnauthorized},
+		{"List", "nobody", http.StatusUnauthorized},
+		{"List", "user", http.StatusOK},
+		{"Delete", "", http.StatusUnauthorized},
+		{"Delete", "user", http.StatusForbidden},
+		{"Delete", "admin", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := callTwirp(router, server.prefix+tt.method, tt.token); got != tt.want {
+			t.Errorf("%s as %q: status %d, want %d", tt.method, tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestTwirpAuthInSecureGroup(t *testing.T) {
+	security.RegisterKey(testKey{})
+	t.Cleanup(func() { security.RegisterKey(nil) })
+
+	methods := NewTwirpAuth().Method("Login", OPEN)
+	server := &testTwirpServer{prefix: "/twirp/twirpauthtest.accounts/", hooks: methods.ServerHooks()}
+	api := Router(&datastore.Datastore{Settings: testSettings{}}).Group("/api", SECURE)
+	api.Twirp(server, OPEN, WithMethodAuth(methods))
+
+	if got := callTwirp(api, server.prefix+"Login", ""); got != http.StatusUnauthorized {
+		t.Errorf("OPEN method in a SECURE group: status %d, want %d", got, http.StatusUnauthorized)
+	}
+	if got := callTwirp(api, server.prefix+"Login", "user"); got != http.StatusOK {
+		t.Errorf("logged in: status %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestTwirpAuthWithoutHooks(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering WithMethodAuth without its ServerHooks didn't panic")
+		}
+	}()
+	methods := NewTwirpAuth().Method("Login", OPEN)
+	router := Router(&datastore.Datastore{Settings: testSettings{}})
+	router.Twirp(&testTwirpServer{prefix: "/twirp/twirpauthtest.unhooked/"}, SECURE, WithMethodAuth(methods))
+}
+
+func TestTwirpAuthNotRegistered(t *testing.T) {
+	methods := NewTwirpAuth()
+	ctx := ctxsetters.WithMethodName(context.Background(), "List")
+	_, err := methods.ServerHooks().RequestRouted(ctx)
+	var twerr twirp.Error
+	if !errors.As(err, &twerr) || twerr.Code() != twirp.Internal {
+		t.Errorf("hooks without WithMethodAuth returned %v, want an internal error", err)
+	}
+}
+
+func callTwirp(router *CustomRouter, path string, token string) int {
+	req := httptest.NewRequest("POST", path, strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Basic "+token)
+	}
+	w := httptest.NewRecorder()
+	router.Mux.ServeHTTP(w, req)
+	return w.Code
+}
@@ -0,0 +1,235 @@
+package mantra
+
+import (
+	"errors"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Validator is implemented by request types with rules of their own, it runs after the tag rules.
+// Return FieldErrors to report per field
+type Validator interface {
+	Validate() error
+}
+
+var regexps sync.Map // rule string to *regexp.Regexp
+
+// Validate checks the struct v (or points at) against its `validate` tags, e.g. `validate:"required,min=3,max=50"`,
+// then calls its Validate method if it's a Validator. Failures come back as a Validation error carrying FieldErrors,
+// keyed by the fields param, query, form or json tag name, in that order, the same as Bind.
+//
+// Rules are required, min=n and max=n (length of strings and slices, value of numbers), email, oneof=a b c,
+// ulid, url and regexp=pattern, which must be the last rule. Optional fields left empty (nil pointers, blank
+// strings, empty slices and maps, zero times and ULIDs) are only checked by required, numbers are always checked
+func Validate(v any) error {
+	fieldErrs := FieldErrors{}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.Struct {
+		validateStruct(rv, fieldErrs)
+	}
+
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			var custom FieldErrors
+			if !errors.As(err, &custom) {
+				return err
+			}
+			for field, msg := range custom {
+				if _, exists := fieldErrs[field]; !exists {
+					fieldErrs[field] = msg
+				}
+			}
+		}
+	}
+
+	if len(fieldErrs) > 0 {
+		return Validation("Please check the highlighted fields", fieldErrs)
+	}
+	return nil
+}
+
+func validateStruct(v reflect.Value, fieldErrs FieldErrors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			validateStruct(v.Field(i), fieldErrs)
+			continue
+		}
+		rules := field.Tag.Get("validate")
+		if rules == "" || !field.IsExported() {
+			continue
+		}
+		if msg := validateField(v.Field(i), rules); msg != "" {
+			fieldErrs[fieldName(field)] = msg
+		}
+	}
+}
+
+// fieldName is what the client calls the field, the tag Bind reads it from first
+// so both report errors under the same name
+func fieldName(field reflect.StructField) string {
+	for _, tag := range []string{"param", "query", "form", "json"} {
+		name, _, _ := strings.Cut(field.Tag.Get(tag), ",")
+		if name != "" && name != "-" {
+			return name
+		}
+	}
+	return field.Name
+}
+
+// validateField returns what's wrong with v, blank when it passes
+func validateField(v reflect.Value, rules string) string {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			break
+		}
+		v = v.Elem()
+	}
+	empty := v.IsZero()
+	optional := isEmpty(v)
+
+	for rules != "" {
+		var rule string
+		if strings.HasPrefix(rules, "regexp=") {
+			rule, rules = rules, "" // may contain commas
+		} else {
+			rule, rules, _ = strings.Cut(rules, ",")
+		}
+		name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+
+		if name == "required" {
+			if empty {
+				return "is required"
+			}
+			continue
+		}
+		if optional {
+			continue
+		}
+		if msg := checkRule(v, name, arg); msg != "" {
+			return msg
+		}
+	}
+	return ""
+}
+
+func checkRule(v reflect.Value, name string, arg string) string {
+	switch name {
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return "has an invalid " + name + " rule"
+		}
+		size, unit := measure(v)
+		if name == "min" && size < limit {
+			return "must be at least " + arg + unit
+		}
+		if name == "max" && size > limit {
+			return "must be at most " + arg + unit
+		}
+	case "email":
+		addr, err := mail.ParseAddress(v.String())
+		if err != nil || addr.Address != v.String() {
+			return "must be a valid email address"
+		}
+	case "oneof":
+		options := strings.Fields(arg)
+		val := stringOf(v)
+		for _, option := range options {
+			if val == option {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(options, ", ")
+	case "ulid":
+		if _, err := ulid.ParseStrict(strings.ToUpper(stringOf(v))); err != nil {
+			return "must be a ULID"
+		}
+	case "url":
+		u, err := url.ParseRequestURI(v.String())
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return "must be a URL"
+		}
+	case "regexp":
+		re, err := compiledRegexp(arg)
+		if err != nil {
+			return "has an invalid regexp rule"
+		}
+		if !re.MatchString(stringOf(v)) {
+			return "is not in the right format"
+		}
+	default:
+		return "has an unknown rule " + name
+	}
+	return ""
+}
+
+// isEmpty is a value with nothing to check, unlike a zero number which can still be out of range
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Struct, reflect.Array: // time.Time, ulid.ULID
+		return v.IsZero()
+	}
+	return false
+}
+
+// measure returns the length of strings and collections, or the value of numbers
+func measure(v reflect.Value) (float64, string) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), ""
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), ""
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), ""
+	}
+	return 0, ""
+}
+
+func stringOf(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return v.String()
+	}
+	if s, ok := v.Interface().(interface{ String() string }); ok {
+		return s.String()
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	}
+	return ""
+}
+
+func compiledRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexps.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexps.Store(pattern, re)
+	return re, nil
+}
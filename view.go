@@ -2,18 +2,20 @@ package mantra
 
 import (
 	"bytes"
-	"errors"
 	"html/template"
 	"log/slog"
+	"maps"
 	"net/http"
-	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nerdynz/datastore"
 
 	"github.com/unrolled/render"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // ViewBucket handles template rendering and data management
@@ -23,36 +25,71 @@ type ViewBucket struct {
 	w        http.ResponseWriter
 	req      *http.Request
 	data     map[string]interface{}
+	flashes  []Flash
 }
 
 var funcmap = map[string]any{}
 
+var (
+	rendererMu      sync.Mutex
+	sharedRenderer  *render.Render
+	reloadTemplates bool
+)
+
+// AddTemplateFunc registers a template func, the shared renderer is rebuilt on next use
 func AddTemplateFunc(name string, fn any) {
+	rendererMu.Lock()
+	defer rendererMu.Unlock()
 	funcmap[name] = fn
+	sharedRenderer = nil
+}
+
+// ReloadTemplates turns on re-parsing of the templates directory on every HTML render.
+// Only intended for development, the default is to parse once per process
+func ReloadTemplates(enabled bool) {
+	rendererMu.Lock()
+	defer rendererMu.Unlock()
+	reloadTemplates = enabled
+	sharedRenderer = nil
+}
+
+// renderer returns the process wide renderer, building it on first use
+func renderer() *render.Render {
+	rendererMu.Lock()
+	defer rendererMu.Unlock()
+	if sharedRenderer == nil {
+		sharedRenderer = render.New(render.Options{
+			Directory:  "templates", // default templates directory
+			Extensions: []string{".html", ".tmpl"},
+			Layout:     "", // default layout file
+			Funcs: []template.FuncMap{
+				helperFuncs,
+				maps.Clone(funcmap), // copied so later AddTemplateFunc calls can't race a render
+			},
+			IsDevelopment: reloadTemplates,
+		})
+	}
+	return sharedRenderer
 }
 
 // NewViewBucket creates a new ViewBucket instance
 func NewViewBucket(w http.ResponseWriter, req *http.Request, store *datastore.Datastore) *ViewBucket {
 	vb := &ViewBucket{
-		w:     w,
-		req:   req,
-		store: store,
-		data:  make(map[string]interface{}),
+		renderer: renderer(),
+		w:        w,
+		req:      req,
+		store:    store,
+		data:     make(map[string]interface{}),
 	}
 
-	// Create a new renderer instance with default options
-	vb.renderer = render.New(render.Options{
-		Directory:  "templates", // default templates directory
-		Extensions: []string{".html", ".tmpl"},
-		Layout:     "", // default layout file
-		Funcs: []template.FuncMap{
-			helperFuncs,
-			funcmap,
-		},
-	})
-
 	vb.Add("Now", time.Now())
 	vb.Add("Year", time.Now().Year())
+	if req != nil && w != nil {
+		if token := CSRFToken(req.Context()); token != "" {
+			vb.Add("CSRFToken", token)
+		}
+		vb.loadFlashes()
+	}
 	return vb
 }
 
@@ -61,33 +98,37 @@ func (vb *ViewBucket) Add(key string, value interface{}) {
 	vb.data[key] = value
 }
 
-// HTML renders an HTML template with the current data
+// HTML renders an HTML template with the current data, plus any form input and errors RedirectWithErrors left
 func (vb *ViewBucket) HTML(status int, templateName string, layout ...string) {
-	if vb.renderer == nil {
-		vb.ErrorHTML(http.StatusInternalServerError, "Renderer not set", errors.New("renderer not set"))
-		return
-	}
-	if vb.store == nil {
-		vb.ErrorHTML(http.StatusInternalServerError, "Store not set", errors.New("store not set"))
+	vb.loadFormState()
+	vb.html(status, templateName, layout...)
+}
+
+func (vb *ViewBucket) html(status int, templateName string, layout ...string) {
+	if !vb.ready() {
 		return
 	}
+	vb.flashesShown() // before the renderer writes the headers
+	_, span := startSpan(vb.req.Context(), "render "+templateName, attribute.String("mantra.template", templateName))
+	defer span.End()
+	var err error
 	if len(layout) > 0 {
-		vb.renderer.HTML(vb.w, status, templateName, vb.data, render.HTMLOptions{
+		span.SetAttributes(attribute.String("mantra.layout", layout[0]))
+		err = vb.renderer.HTML(vb.w, status, templateName, vb.data, render.HTMLOptions{
 			Layout: layout[0],
 		})
 	} else {
-		vb.renderer.HTML(vb.w, status, templateName, vb.data)
+		err = vb.renderer.HTML(vb.w, status, templateName, vb.data)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
 }
 
 // Text renders plain text
 func (vb *ViewBucket) Text(status int, text string) {
-	if vb.renderer == nil {
-		vb.ErrorText(http.StatusInternalServerError, "Renderer not set", errors.New("renderer not set"))
-		return
-	}
-	if vb.store == nil {
-		vb.ErrorText(http.StatusInternalServerError, "Store not set", errors.New("store not set"))
+	if !vb.ready() {
 		return
 	}
 	vb.renderer.Text(vb.w, status, text)
@@ -95,45 +136,42 @@ func (vb *ViewBucket) Text(status int, text string) {
 
 // JSON renders JSON data
 func (vb *ViewBucket) JSON(status int, data interface{}) {
+	if !vb.ready() {
+		return
+	}
 	vb.renderer.JSON(vb.w, status, data)
 }
 
-// createErrorData creates a standardized error data structure
-func (vb *ViewBucket) createErrorData(friendly string, errs ...error) *errorData {
-	errStr := ""
-	lineNumber := -1
-	funcName := "Not Specified"
-	fileName := "Not Specified"
-
-	if len(errs) > 0 {
-		for _, err := range errs {
-			if err != nil {
-				errStr += err.Error() + "\n"
-			} else {
-				errStr += "No Error Specified \n"
-			}
-		}
-		// notice that we're using 1, so it will actually log the where
-		// the error happened, 0 = this function, we don't want that.
-		pc, file, line, _ := runtime.Caller(2)
-		lineNumber = line
-		funcName = runtime.FuncForPC(pc).Name()
-		fileName = file
+// ready checks there's a renderer and store, responding with a bare 500 when there isn't.
+// Not through Error, it renders with them too
+func (vb *ViewBucket) ready() bool {
+	msg := ""
+	switch {
+	case vb.renderer == nil:
+		msg = "renderer not set"
+	case vb.store == nil:
+		msg = "store not set"
+	default:
+		return true
 	}
+	slog.ErrorContext(vb.req.Context(), "mantra: can't render", "error", msg)
+	http.Error(vb.w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	return false
+}
 
-	return &errorData{
-		friendly,
-		errStr,
-		lineNumber,
-		funcName,
-		fileName,
-	}
+// createErrorData creates a standardized error data structure
+func (vb *ViewBucket) createErrorData(friendly string, errs ...error) *errorData {
+	return newErrorData(vb.req, friendly, errs)
 }
 
-// Error handles errors with appropriate response type based on Accept header
+// Error handles errors with appropriate response type based on Accept header.
+// A status of 0 or blank friendly message are worked out from the first error, see StatusFor and FriendlyFor
 func (vb *ViewBucket) Error(status int, friendly string, errs ...error) {
+	status, friendly = errorDefaults(status, friendly, errs)
 	accept := vb.req.Header.Get("Accept")
 	switch {
+	case wantsProblem(vb.req):
+		vb.ErrorProblem(status, friendly, errs...)
 	case strings.Contains(accept, "text/html"):
 		vb.ErrorHTML(status, friendly, errs...)
 	case strings.Contains(accept, "application/json"):
@@ -143,32 +181,49 @@ func (vb *ViewBucket) Error(status int, friendly string, errs ...error) {
 	}
 }
 
+// ErrorFrom renders err with the status and friendly message it maps to, e.g. mantra.NotFound("No such invoice", err)
+func (vb *ViewBucket) ErrorFrom(err error) {
+	vb.Error(0, "", err)
+}
+
 // ErrorHTML renders an error template
 func (vb *ViewBucket) ErrorHTML(status int, friendly string, errs ...error) {
 	data := vb.createErrorData(friendly, errs...)
-	slog.Error(data.nicelyFormatted())
+	slog.ErrorContext(vb.req.Context(), data.nicelyFormatted())
+	data = data.forClient(showErrorDetails(vb.req, vb.store))
 
+	vb.Add("ErrorReference", data.Reference)
 	vb.Add("FriendlyError", data.Friendly)
 	vb.Add("NastyError", data.Error)
 	vb.Add("LineNumber", data.LineNumber)
 	vb.Add("FuncName", data.FunctionName)
 	vb.Add("FileName", data.FileName)
+	vb.Add("RequestID", data.RequestID)
+	vb.Add("TraceID", data.TraceID)
 	vb.Add("ErrorCode", status)
-	vb.HTML(status, "error")
+	vb.Add("FieldErrors", data.Fields)
+	vb.html(status, "error") // leaves any form errors for the form
 }
 
 // ErrorText renders error as plain text
 func (vb *ViewBucket) ErrorText(status int, friendly string, errs ...error) {
 	data := vb.createErrorData(friendly, errs...)
-	slog.Error(data.nicelyFormatted())
-	vb.Text(status, data.nicelyFormatted())
+	slog.ErrorContext(vb.req.Context(), data.nicelyFormatted())
+	vb.Text(status, data.forClient(showErrorDetails(vb.req, vb.store)).nicelyFormatted())
 }
 
 // ErrorJSON renders error as JSON
 func (vb *ViewBucket) ErrorJSON(status int, friendly string, errs ...error) {
 	data := vb.createErrorData(friendly, errs...)
-	slog.Error(data.nicelyFormatted())
-	vb.JSON(status, data)
+	slog.ErrorContext(vb.req.Context(), data.nicelyFormatted())
+	vb.JSON(status, data.forClient(showErrorDetails(vb.req, vb.store)))
+}
+
+// ErrorProblem renders error as RFC 7807 application/problem+json, pass a *Problem in errs to set its members
+func (vb *ViewBucket) ErrorProblem(status int, friendly string, errs ...error) {
+	data := vb.createErrorData(friendly, errs...)
+	slog.ErrorContext(vb.req.Context(), data.nicelyFormatted())
+	writeProblem(vb.w, problemFor(vb.req, status, data.forClient(showErrorDetails(vb.req, vb.store)), errs))
 }
 
 // Redirect performs an HTTP redirect
@@ -0,0 +1,88 @@
+package mantra
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nerdynz/datastore"
+)
+
+// withTemplates runs the test from a directory holding a small templates tree
+func withTemplates(b testing.TB) {
+	b.Helper()
+	dir := b.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "templates"), 0o755); err != nil {
+		b.Fatal(err)
+	}
+	for _, name := range []string{"page", "list", "form", "error"} {
+		page := `<h1>{{title .Title}}</h1><ul>{{range .Items}}<li>{{.}}</li>{{end}}</ul><footer>{{.Year}}</footer>`
+		if err := os.WriteFile(filepath.Join(dir, "templates", name+".html"), []byte(page), 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		b.Fatal(err)
+	}
+	ReloadTemplates(false)
+	b.Cleanup(func() {
+		os.Chdir(wd)
+		ReloadTemplates(false)
+	})
+}
+
+func BenchmarkNewViewBucket(b *testing.B) {
+	withTemplates(b)
+	store := &datastore.Datastore{}
+	req := httptest.NewRequest("GET", "/", nil)
+
+	b.Run("shared renderer", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			NewViewBucket(httptest.NewRecorder(), req, store)
+		}
+	})
+	b.Run("renderer per request", func(b *testing.B) { // how every ViewBucket worked before the shared renderer
+		for i := 0; i < b.N; i++ {
+			rendererMu.Lock()
+			sharedRenderer = nil
+			rendererMu.Unlock()
+			NewViewBucket(httptest.NewRecorder(), req, store)
+		}
+	})
+}
+
+func BenchmarkHTML(b *testing.B) {
+	withTemplates(b)
+	store := &datastore.Datastore{}
+	req := httptest.NewRequest("GET", "/", nil)
+	render := func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			vb := NewViewBucket(httptest.NewRecorder(), req, store)
+			vb.Add("Title", "benchmark")
+			vb.Add("Items", []string{"one", "two", "three"})
+			vb.HTML(200, "page")
+		}
+	}
+
+	b.Run("shared renderer", render)
+	b.Run("reload templates", func(b *testing.B) {
+		ReloadTemplates(true)
+		defer ReloadTemplates(false)
+		render(b)
+	})
+}
+
+// testSettings is a development environment
+type testSettings struct{}
+
+func (testSettings) Get(key string) string                { return "" }
+func (testSettings) GetDuration(key string) time.Duration { return 0 }
+func (testSettings) GetBool(key string) bool              { return false }
+func (testSettings) IsProduction() bool                   { return false }
+func (testSettings) IsDevelopment() bool                  { return true }